@@ -0,0 +1,123 @@
+package wsheartbeat
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"time"
+)
+
+// adaptiveCleanCycles is the number of consecutive timely pongs after which an
+// adaptive interval relaxes.
+const adaptiveCleanCycles = 4
+
+// AdaptiveConfig makes the ping interval of each connection follow its pongs: it
+// tightens when pongs are missed or slow, for faster failure detection on poor
+// links, and relaxes while the link is healthy.
+type AdaptiveConfig struct {
+	// MinInterval is the shortest interval as a string (default: a quarter of the
+	// interval).
+	MinInterval string `json:"min_interval,omitempty"`
+	// MaxInterval is the longest interval as a string (default: four intervals).
+	MaxInterval string `json:"max_interval,omitempty"`
+}
+
+// withAdaptive returns hb with the interval bounds of a applied. The interval of each
+// connection starts at hb.interval, clamped to the bounds.
+func (hb heartbeat) withAdaptive(a *AdaptiveConfig) (heartbeat, error) {
+	if a == nil || hb.interval == 0 {
+		return hb, nil
+	}
+	hb.minInterval, hb.maxInterval = hb.interval/4, hb.interval*4
+	if a.MinInterval != "" {
+		dur, err := time.ParseDuration(a.MinInterval)
+		if err != nil || dur <= 0 {
+			return hb, fmt.Errorf("invalid adaptive min interval: %s", a.MinInterval)
+		}
+		hb.minInterval = dur
+	}
+	if a.MaxInterval != "" {
+		dur, err := time.ParseDuration(a.MaxInterval)
+		if err != nil || dur <= 0 {
+			return hb, fmt.Errorf("invalid adaptive max interval: %s", a.MaxInterval)
+		}
+		hb.maxInterval = dur
+	}
+	if hb.minInterval > hb.maxInterval {
+		return hb, fmt.Errorf("adaptive min interval %s exceeds max interval %s", hb.minInterval, hb.maxInterval)
+	}
+	// The jitter must leave the shortest interval positive.
+	if hb.jitter >= hb.minInterval {
+		return hb, fmt.Errorf("jitter %s must be shorter than the adaptive min interval %s", hb.jitter, hb.minInterval)
+	}
+	return hb, nil
+}
+
+// unmarshalCaddyfile parses the optional min and max interval arguments and the block
+// of adaptive.
+func (a *AdaptiveConfig) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	switch len(args) {
+	case 0:
+	case 2:
+		a.MinInterval, a.MaxInterval = args[0], args[1]
+	default:
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "min_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.MinInterval = d.Val()
+		case "max_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.MaxInterval = d.Val()
+		default:
+			return d.Errf("unknown adaptive option: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// adaptiveState is the adaptive interval of one connection. It only depends on the
+// outcomes it observes, not on the clock.
+type adaptiveState struct {
+	// min and max bound the interval.
+	min, max time.Duration
+	// current is the interval to wait before the next ping.
+	current time.Duration
+	// clean counts the consecutive timely pongs since the last change.
+	clean int
+}
+
+// newAdaptiveState returns the adaptive interval of a connection pinged with hb.
+func newAdaptiveState(hb heartbeat) *adaptiveState {
+	return &adaptiveState{
+		min:     hb.minInterval,
+		max:     hb.maxInterval,
+		current: min(max(hb.interval, hb.minInterval), hb.maxInterval),
+	}
+}
+
+// observe updates the interval with the outcome of the last ping and returns it. A
+// missed pong halves the interval and a slow one holds it; adaptiveCleanCycles timely
+// pongs in a row extend it by 25%.
+func (a *adaptiveState) observe(answered, slow bool) time.Duration {
+	switch {
+	case !answered:
+		a.current = max(a.current/2, a.min)
+		a.clean = 0
+	case slow:
+		a.clean = 0
+	default:
+		a.clean++
+		if a.clean >= adaptiveCleanCycles {
+			a.current = min(a.current+a.current/4, a.max)
+			a.clean = 0
+		}
+	}
+	return a.current
+}
@@ -0,0 +1,188 @@
+package wsheartbeat
+
+import (
+	"github.com/gorilla/websocket"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeTimer is a timer of fakeClock, fired by the test.
+type fakeTimer struct {
+	// d is the duration the timer was made with.
+	d time.Duration
+	// c fires the timer.
+	c chan time.Time
+	// resets receives the duration of each Reset.
+	resets chan time.Duration
+}
+
+func (t *fakeTimer) C() <-chan time.Time        { return t.c }
+func (t *fakeTimer) Reset(d time.Duration) bool { t.resets <- d; return true }
+func (t *fakeTimer) Stop() bool                 { return true }
+
+// fakeClock makes the timers of the ping loop, which only fire when the test says so.
+type fakeClock struct {
+	// timers receives every timer made, in order.
+	timers chan *fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{timers: make(chan *fakeTimer, 16)}
+}
+
+func (c *fakeClock) newTimer(d time.Duration) timer {
+	t := &fakeTimer{d: d, c: make(chan time.Time), resets: make(chan time.Duration, 16)}
+	c.timers <- t
+	return t
+}
+
+func TestAdaptiveStateObserve(t *testing.T) {
+	a := newAdaptiveState(heartbeat{interval: 8 * time.Second, minInterval: 2 * time.Second, maxInterval: 12 * time.Second})
+	steps := []struct {
+		answered, slow bool
+		want           time.Duration
+	}{
+		{false, false, 4 * time.Second},
+		{false, false, 2 * time.Second},
+		{false, false, 2 * time.Second}, // clamped to the min
+		{true, false, 2 * time.Second},
+		{true, false, 2 * time.Second},
+		{true, true, 2 * time.Second}, // a slow pong restarts the clean cycles
+		{true, false, 2 * time.Second},
+		{true, false, 2 * time.Second},
+		{true, false, 2 * time.Second},
+		{true, false, 2500 * time.Millisecond},
+	}
+	for i, step := range steps {
+		if got := a.observe(step.answered, step.slow); got != step.want {
+			t.Fatalf("step %d: interval = %s, want %s", i, got, step.want)
+		}
+	}
+	// A long healthy run relaxes the interval up to the max.
+	for range 100 {
+		a.observe(true, false)
+	}
+	if a.current != 12*time.Second {
+		t.Fatalf("interval = %s after a healthy run, want the max 12s", a.current)
+	}
+}
+
+func TestAdaptivePingLoop(t *testing.T) {
+	m := testHeartbeat()
+	clock := newFakeClock()
+	m.timers = clock.newTimer
+	sess, client, backend := testSession(t)
+	defer sess.finish()
+	defer client.Close()
+	defer backend.Close()
+
+	pinged := make(chan struct{}, 16)
+	client.SetPingHandler(func(string) error {
+		pinged <- struct{}{}
+		return nil
+	})
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	hb := heartbeat{interval: 8 * time.Second, minInterval: 2 * time.Second, maxInterval: 16 * time.Second}
+	go m.handlePing(sess, &sess.client, hb)
+	ping := <-clock.timers
+	if ping.d != 8*time.Second {
+		t.Fatalf("first ping after %s, want 8s", ping.d)
+	}
+
+	// tick fires the ping timer, answering the ping it sends unless the peer is lost,
+	// and returns the interval the timer was rearmed with.
+	tick := func(answer, slow bool) time.Duration {
+		t.Helper()
+		ping.c <- time.Now()
+		interval := <-ping.resets
+		select {
+		case <-pinged:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no ping sent")
+		}
+		if answer {
+			if slow {
+				sess.client.rtt.Store(int64(time.Second))
+				sess.client.avgRTT.Store(int64(100 * time.Millisecond))
+			} else {
+				sess.client.rtt.Store(int64(100 * time.Millisecond))
+			}
+			sess.client.markAlive()
+			waitFor(t, "the pong to be seen", func() bool { return len(sess.client.alive) == 0 })
+		}
+		return interval
+	}
+
+	// Each interval follows the outcome of the ping before it.
+	steps := []struct {
+		answer, slow bool
+		want         time.Duration
+	}{
+		{false, false, 8 * time.Second}, // nothing observed before the first ping
+		{false, false, 4 * time.Second},
+		{true, false, 2 * time.Second},
+		{true, true, 2 * time.Second},
+		{true, false, 2 * time.Second},
+		{true, false, 2 * time.Second},
+		{true, false, 2 * time.Second},
+		{true, false, 2 * time.Second},
+		{true, false, 2500 * time.Millisecond},
+	}
+	for i, step := range steps {
+		if got := tick(step.answer, step.slow); got != step.want {
+			t.Fatalf("tick %d: interval = %s, want %s", i, got, step.want)
+		}
+	}
+}
+
+func TestAdaptiveIntervalKeepsReadDeadline(t *testing.T) {
+	m := &WSHeartbeat{Interval: "100ms", ReadDeadlineGrace: "20ms", Adaptive: &AdaptiveConfig{}}
+	proxy := serveProxy(t, m, echoBackend(t, nil))
+	conn, _, err := dialProxy(t, proxy, "/ws", nil)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	// Answer every ping, so the interval relaxes past the base interval plus grace.
+	var pings atomic.Int64
+	conn.SetPingHandler(func(appData string) error {
+		pings.Add(1)
+		return conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+	})
+	echoed := make(chan []byte, 1)
+	go func() {
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				close(echoed)
+				return
+			}
+			echoed <- msg
+		}
+	}()
+	time.Sleep(1500 * time.Millisecond)
+	if got := pings.Load(); got < 6 {
+		t.Fatalf("got %d pings, want enough for the interval to relax", got)
+	}
+
+	// The connection still proxies messages.
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg, ok := <-echoed:
+		if !ok || string(msg) != "last" {
+			t.Fatalf("got %q, %v; want the echo of the last message", msg, ok)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no echo of the last message")
+	}
+}
@@ -0,0 +1,176 @@
+package wsheartbeat
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// handlers tracks the provisioned ws_heartbeat handlers for the admin API.
+var (
+	handlersMu sync.Mutex
+	handlers   = make(map[*WSHeartbeat]struct{})
+)
+
+func init() {
+	// Register the admin API endpoints.
+	caddy.RegisterModule(Admin{})
+}
+
+// Admin exposes the state of the ws_heartbeat handlers on the admin API.
+type Admin struct{}
+
+// CaddyModule returns the Caddy module information.
+func (Admin) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.ws_heartbeat",
+		New: func() caddy.Module { return new(Admin) },
+	}
+}
+
+// Routes returns the admin routes served by the module.
+func (a Admin) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/ws_heartbeat/upstreams",
+			Handler: caddy.AdminHandlerFunc(a.handleUpstreams),
+		},
+		{
+			Pattern: "/ws_heartbeat/connections",
+			Handler: caddy.AdminHandlerFunc(a.handleConnections),
+		},
+	}
+}
+
+// upstreamStatus is the admin API view of an upstream.
+type upstreamStatus struct {
+	Host     string `json:"host"`
+	Conns    int64  `json:"conns"`
+	MaxConns int    `json:"max_conns,omitempty"`
+	Healthy  bool   `json:"healthy"`
+	Weight   int    `json:"weight"`
+}
+
+// handleUpstreams lists the upstreams of every handler with their connection counts.
+func (a Admin) handleUpstreams(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	handlersMu.Lock()
+	statuses := []upstreamStatus{}
+	for m := range handlers {
+		for _, up := range m.allUpstreams() {
+			statuses = append(statuses, upstreamStatus{
+				Host:     up.host,
+				Conns:    up.conns.Load(),
+				MaxConns: m.MaxConnsPerUpstream,
+				Healthy:  !up.unhealthy.Load(),
+				Weight:   up.weight,
+			})
+		}
+	}
+	handlersMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(statuses)
+}
+
+// legStatus is the admin API view of the liveness of one leg of a connection.
+type legStatus struct {
+	Pings       int64         `json:"pings"`
+	PeerPings   int64         `json:"pings_received"`
+	Pongs       int64         `json:"pongs"`
+	LastPong    *time.Time    `json:"last_pong,omitempty"`
+	MissedPongs int64         `json:"missed_pongs"`
+	RTT         time.Duration `json:"rtt_ns"`
+	AvgRTT      time.Duration `json:"avg_rtt_ns"`
+}
+
+// connectionStatus is the admin API view of a proxied connection.
+type connectionStatus struct {
+	RequestID    string    `json:"request_id"`
+	ClientIP     string    `json:"client_ip"`
+	RemoteAddr   string    `json:"remote_addr"`
+	Upstream     string    `json:"upstream"`
+	Started      time.Time `json:"started"`
+	LastActivity time.Time `json:"last_activity"`
+	Client       legStatus `json:"client"`
+	Backend      legStatus `json:"backend"`
+}
+
+// handleConnections lists the connections proxied by every handler with their
+// liveness state.
+func (a Admin) handleConnections(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	handlersMu.Lock()
+	statuses := []connectionStatus{}
+	for m := range handlers {
+		m.mu.Lock()
+		for _, sess := range m.connections {
+			statuses = append(statuses, sess.status())
+		}
+		m.mu.Unlock()
+	}
+	handlersMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(statuses)
+}
+
+// status returns the admin API view of the session. The counters are read atomically,
+// so it may be called while the connection is proxied.
+func (s *session) status() connectionStatus {
+	return connectionStatus{
+		RequestID:    s.requestID,
+		ClientIP:     s.clientIP,
+		RemoteAddr:   s.client.conn.RemoteAddr().String(),
+		Upstream:     s.up.host,
+		Started:      s.started,
+		LastActivity: monoEpoch.Add(time.Duration(s.lastActivity.Load())),
+		Client:       s.client.status(),
+		Backend:      s.backend.status(),
+	}
+}
+
+// status returns the admin API view of the liveness of the leg.
+func (l *leg) status() legStatus {
+	status := legStatus{
+		Pings:       l.pings.Load(),
+		PeerPings:   l.peerPings.Load(),
+		Pongs:       l.pongs.Load(),
+		MissedPongs: l.missedPongs.Load(),
+		RTT:         time.Duration(l.rtt.Load()),
+		AvgRTT:      time.Duration(l.avgRTT.Load()),
+	}
+	if last := l.lastPong.Load(); last != 0 {
+		at := monoEpoch.Add(time.Duration(last))
+		status.LastPong = &at
+	}
+	return status
+}
+
+// registerHandler makes m visible on the admin API until unregisterHandler is called.
+func registerHandler(m *WSHeartbeat) {
+	handlersMu.Lock()
+	handlers[m] = struct{}{}
+	handlersMu.Unlock()
+}
+
+// unregisterHandler removes m from the admin API.
+func unregisterHandler(m *WSHeartbeat) {
+	handlersMu.Lock()
+	delete(handlers, m)
+	handlersMu.Unlock()
+}
+
+// Interface guard
+var _ caddy.AdminRouter = (*Admin)(nil)
@@ -0,0 +1,50 @@
+package wsheartbeat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConnectionsListRequestIDAndClientIP(t *testing.T) {
+	m := &WSHeartbeat{TrustedProxies: []string{"127.0.0.1/8"}}
+	proxy := serveProxy(t, m, echoBackend(t, nil))
+	header := http.Header{}
+	header.Set("X-Request-Id", "req-53")
+	header.Set("X-Forwarded-For", "203.0.113.7")
+	conn, _, err := dialProxy(t, proxy, "/ws", header)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+
+	// list returns the connections of m on the admin API.
+	list := func() []connectionStatus {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		if err := (Admin{}).handleConnections(rec, httptest.NewRequest(http.MethodGet, "/ws_heartbeat/connections", nil)); err != nil {
+			t.Fatal(err)
+		}
+		var statuses []connectionStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &statuses); err != nil {
+			t.Fatal(err)
+		}
+		var ours []connectionStatus
+		for _, status := range statuses {
+			if status.RequestID == "req-53" {
+				ours = append(ours, status)
+			}
+		}
+		return ours
+	}
+	var statuses []connectionStatus
+	waitFor(t, "the connection to be listed", func() bool {
+		statuses = list()
+		return len(statuses) == 1
+	})
+	// The client IP is the one forwarded by the trusted proxy, not the peer address.
+	if got := statuses[0].ClientIP; got != "203.0.113.7" {
+		t.Fatalf("client_ip = %q, want 203.0.113.7", got)
+	}
+}
@@ -0,0 +1,55 @@
+package wsheartbeat
+
+import (
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// provisionMetrics registers the rejection counter with the metrics registry of ctx,
+// sharing it with the other handlers of the configuration.
+func (m *WSHeartbeat) provisionMetrics(ctx caddy.Context) error {
+	m.rejections = nil
+	registry := ctx.GetMetricsRegistry()
+	if !m.Metrics || registry == nil {
+		return nil
+	}
+	rejections := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "ws_heartbeat",
+		Name:      "upgrades_rejected_total",
+		Help:      "Websocket upgrades rejected by the ws_heartbeat handler, by reason.",
+	}, []string{"reason"})
+	if err := registry.Register(rejections); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if !errors.As(err, &registered) {
+			return err
+		}
+		existing, ok := registered.ExistingCollector.(*prometheus.CounterVec)
+		if !ok {
+			return err
+		}
+		rejections = existing
+	}
+	m.rejections = rejections
+	return nil
+}
+
+// denyUpgrade records the rejection of the upgrade r for reason: a warning for
+// audits, with the request's details, and the rejection counter, if metrics are on.
+// Reasons are stable, so they can be alerted on.
+func (m *WSHeartbeat) denyUpgrade(logger *zap.Logger, r *http.Request, reason string, fields ...zap.Field) {
+	fields = append([]zap.Field{
+		zap.String("reason", reason),
+		zap.String("path", r.URL.Path),
+		zap.String("origin", r.Header.Get("Origin")),
+		zap.String("user_agent", r.UserAgent()),
+		zap.String("remote_addr", r.RemoteAddr),
+	}, fields...)
+	logger.Warn("websocket upgrade denied", fields...)
+	if m.rejections != nil {
+		m.rejections.WithLabelValues(reason).Inc()
+	}
+}
@@ -0,0 +1,85 @@
+package wsheartbeat
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"net/http"
+)
+
+// BackendAuth sets the Authorization header of the backend handshake, with
+// credentials that live in Caddy's configuration rather than in the client. Values
+// accept placeholders, such as {env.WS_TOKEN}. They are never logged.
+type BackendAuth struct {
+	// Bearer is the token sent as "Authorization: Bearer <token>".
+	Bearer string `json:"bearer,omitempty"`
+	// Username and Password are sent as HTTP basic credentials.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// PreserveClientAuth keeps the client's own Authorization header when it sent
+	// one, instead of overwriting it.
+	PreserveClientAuth bool `json:"preserve_client_auth,omitempty"`
+}
+
+// validate checks that exactly one kind of credentials is configured.
+func (a *BackendAuth) validate() error {
+	switch {
+	case a.Bearer != "" && a.Username != "":
+		return fmt.Errorf("backend_auth: bearer and basic credentials are exclusive")
+	case a.Bearer == "" && a.Username == "":
+		return fmt.Errorf("backend_auth: bearer or basic credentials must be specified")
+	}
+	return nil
+}
+
+// apply sets the Authorization header on h, the headers cloned from the client's
+// request, replacing placeholders with repl.
+func (a *BackendAuth) apply(h http.Header, repl *caddy.Replacer) {
+	if a.PreserveClientAuth && h.Get("Authorization") != "" {
+		return
+	}
+	if a.Bearer != "" {
+		h.Set("Authorization", "Bearer "+repl.ReplaceAll(a.Bearer, ""))
+		return
+	}
+	credentials := repl.ReplaceAll(a.Username, "") + ":" + repl.ReplaceAll(a.Password, "")
+	h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+}
+
+// unmarshalCaddyfile parses the block of backend_auth.
+func (a *BackendAuth) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "bearer":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.Bearer = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "basic":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			a.Username, a.Password = args[0], args[1]
+		case "preserve_client_auth":
+			// Parse the optional on/off flag; no argument means on.
+			a.PreserveClientAuth = true
+			if d.NextArg() {
+				switch d.Val() {
+				case "on":
+				case "off":
+					a.PreserveClientAuth = false
+				default:
+					return d.Errf("preserve_client_auth must be on or off, got %s", d.Val())
+				}
+			}
+		default:
+			return d.Errf("unknown backend_auth option: %s", d.Val())
+		}
+	}
+	return nil
+}
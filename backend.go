@@ -0,0 +1,513 @@
+package wsheartbeat
+
+import (
+	"context"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// BackendRoute maps a set of request paths to backend hosts.
+type BackendRoute struct {
+	// BackendHost is the list of backend websocket server hosts, in the same forms as
+	// WSHeartbeat.BackendHost.
+	BackendHost HostList `json:"backend_host,omitempty"`
+	// BackendPaths is a list of allowed paths routed to BackendHost.
+	// Placeholders are replaced per request. A path starting with "~" is a regular
+	// expression matched against the request path, whose groups become the
+	// {ws.path.N} and {ws.path.name} placeholders. A route without paths gets every
+	// upgrade that no earlier route matched.
+	BackendPaths []string `json:"backend_paths,omitempty"`
+	// BackendWeights optionally gives the weight of each BackendHost entry, in order,
+	// in the same form as WSHeartbeat.BackendWeights.
+	BackendWeights []int `json:"backend_weights,omitempty"`
+
+	// pathRegexps holds the compiled regular expression of each BackendPaths entry
+	// starting with "~", and nil for the others.
+	pathRegexps []*regexp.Regexp
+	// filePaths holds the paths loaded from WSHeartbeat.BackendPathsFile, for the first
+	// route. It is swapped as a whole on reload, and nil without a file.
+	filePaths atomic.Pointer[pathList]
+	// subprotocol is the offered subprotocol that selects the route, for the internal
+	// routes of ProtocolRoutes. Such routes are never matched by path.
+	subprotocol string
+	// hostPattern is the request host that selects the route, for the internal routes
+	// of HostRoutes. Such routes are never matched by path.
+	hostPattern string
+	// upstreams holds one parsed upstream per BackendHost entry.
+	upstreams []*upstream
+	// dynamic reports whether the route gets its upstreams from the handler's
+	// dynamic upstream source, with BackendHost as the fallback.
+	dynamic bool
+	// next is the round-robin counter used to pick an upstream.
+	next atomic.Uint64
+	// weighted reports whether BackendWeights are set, enabling smooth weighted round-robin.
+	weighted bool
+	// wrrMu protects the current weights of the upstreams during weighted selection.
+	wrrMu sync.Mutex
+}
+
+// provisionRoutes validates every route, parses its backend host, and rejects paths
+// claimed by more than one route.
+func (m *WSHeartbeat) provisionRoutes() error {
+	owners := make(map[string]int)
+	for i, route := range m.routes {
+		if len(route.BackendHost) == 0 && !route.dynamic {
+			return fmt.Errorf("route %d: backend host must be specified", i)
+		}
+		if len(route.BackendWeights) > 0 && len(route.BackendWeights) != len(route.BackendHost) {
+			return fmt.Errorf("route %d: %d backend weights given for %d backend hosts",
+				i, len(route.BackendWeights), len(route.BackendHost))
+		}
+		route.weighted = len(route.BackendWeights) > 0
+		route.upstreams = nil
+		for j, host := range route.BackendHost {
+			if host == "" {
+				return fmt.Errorf("route %d: backend host must not be empty", i)
+			}
+			// Placeholders are replaced per request, so only the static portions of
+			// such a host are validated here.
+			target, err := parseBackendHost(stubPlaceholders(host))
+			if err != nil {
+				return fmt.Errorf("route %d: %v", i, err)
+			}
+			weight := 1
+			if route.weighted {
+				weight = route.BackendWeights[j]
+				if weight < 0 {
+					return fmt.Errorf("route %d: invalid weight %d for %s", i, weight, host)
+				}
+			}
+			route.upstreams = append(route.upstreams, &upstream{
+				host:    host,
+				target:  target,
+				dynamic: hasPlaceholders(host),
+				weight:  weight,
+			})
+		}
+		// Compile the regular expression paths.
+		route.pathRegexps = make([]*regexp.Regexp, len(route.BackendPaths))
+		for j, p := range route.BackendPaths {
+			if expr, ok := strings.CutPrefix(p, "~"); ok {
+				pattern := expr
+				if m.MatchOptions != nil && m.MatchOptions.CaseInsensitive {
+					pattern = "(?i)" + pattern
+				}
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return fmt.Errorf("route %d: invalid backend path regexp %s: %v", i, expr, err)
+				}
+				route.pathRegexps[j] = re
+			}
+		}
+		// Paths with placeholders can only be compared per request, and regular
+		// expressions may overlap.
+		for j, p := range route.BackendPaths {
+			if hasPlaceholders(p) || route.pathRegexps[j] != nil {
+				continue
+			}
+			if owner, ok := owners[p]; ok && owner != i {
+				return fmt.Errorf("backend path %s is routed to both %s and %s",
+					p, m.routes[owner].BackendHost, route.BackendHost)
+			}
+			owners[p] = i
+		}
+	}
+	return nil
+}
+
+// MatchOptions loosen the comparison of request paths with the backend paths.
+type MatchOptions struct {
+	// CaseInsensitive compares paths regardless of letter case.
+	CaseInsensitive bool `json:"case_insensitive,omitempty"`
+	// IgnoreTrailingSlash ignores trailing slashes of the request path.
+	IgnoreTrailingSlash bool `json:"ignore_trailing_slash,omitempty"`
+}
+
+// matchOptions returns the configured match options, or the strict defaults.
+func (m *WSHeartbeat) matchOptions() *MatchOptions {
+	if m.MatchOptions == nil {
+		return &MatchOptions{}
+	}
+	return m.MatchOptions
+}
+
+// trim removes the trailing slashes of path when they are ignored.
+func (o *MatchOptions) trim(path string) string {
+	if !o.IgnoreTrailingSlash || path == "/" {
+		return path
+	}
+	if trimmed := strings.TrimRight(path, "/"); trimmed != "" {
+		return trimmed
+	}
+	return "/"
+}
+
+// equal reports whether two trimmed paths match.
+func (o *MatchOptions) equal(a, b string) bool {
+	return a == b || o.CaseInsensitive && strings.EqualFold(a, b)
+}
+
+// hasPrefix reports whether path starts with prefix.
+func (o *MatchOptions) hasPrefix(path, prefix string) bool {
+	return len(path) >= len(prefix) && o.equal(path[:len(prefix)], prefix)
+}
+
+// provisionExcludes compiles the regular expressions of ExcludePaths, and warns when
+// they exclude every backend path.
+func (m *WSHeartbeat) provisionExcludes() error {
+	m.excludeRegexps = make([]*regexp.Regexp, len(m.ExcludePaths))
+	for i, p := range m.ExcludePaths {
+		if expr, ok := strings.CutPrefix(p, "~"); ok {
+			if m.matchOptions().CaseInsensitive {
+				expr = "(?i)" + expr
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return fmt.Errorf("invalid exclude path regexp %s: %v", p[1:], err)
+			}
+			m.excludeRegexps[i] = re
+		}
+	}
+	if len(m.ExcludePaths) == 0 {
+		return nil
+	}
+	// Only literal backend paths can be checked before requests arrive.
+	repl := caddy.NewReplacer()
+	for _, route := range m.routes {
+		if len(route.BackendPaths) == 0 || route.filePaths.Load() != nil {
+			return nil
+		}
+		for i, p := range route.BackendPaths {
+			if hasPlaceholders(p) || route.pathRegexps[i] != nil || !m.excluded(p, repl) {
+				return nil
+			}
+		}
+	}
+	m.logger.Warn("every backend path is excluded, no upgrade will be proxied",
+		zap.Strings("exclude_paths", m.ExcludePaths),
+	)
+	return nil
+}
+
+// excluded reports whether path matches one of ExcludePaths: exactly, by prefix for
+// paths ending in "*", or by regular expression for paths starting with "~".
+func (m *WSHeartbeat) excluded(path string, repl *caddy.Replacer) bool {
+	opts := m.matchOptions()
+	path = opts.trim(path)
+	for i, p := range m.ExcludePaths {
+		if re := m.excludeRegexps[i]; re != nil {
+			if re.MatchString(path) {
+				return true
+			}
+			continue
+		}
+		p = repl.ReplaceAll(p, "")
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if opts.hasPrefix(path, prefix) {
+				return true
+			}
+			continue
+		}
+		if opts.equal(opts.trim(p), path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRoute returns the first route whose paths allow path, or that has none, or nil,
+// along with the normalized path to forward: the matching backend path with
+// placeholders replaced, or path without its trailing slashes if ignored. The groups
+// of a matching regular expression are set on repl.
+func (m *WSHeartbeat) matchRoute(path string, repl *caddy.Replacer) (*BackendRoute, string) {
+	opts := m.matchOptions()
+	path = opts.trim(path)
+	for _, route := range m.routes {
+		if route.subprotocol != "" || route.hostPattern != "" {
+			continue
+		}
+		files := route.filePaths.Load()
+		if len(route.BackendPaths) == 0 && files == nil {
+			return route, path
+		}
+		if matched, ok := matchPaths(route.BackendPaths, route.pathRegexps, path, repl, opts); ok {
+			return route, matched
+		}
+		if files != nil {
+			if matched, ok := matchPaths(files.paths, files.regexps, path, repl, opts); ok {
+				return route, matched
+			}
+		}
+	}
+	return nil, ""
+}
+
+// matchPaths reports whether one of paths allows path, along with the normalized path
+// to forward. regexps holds the compiled regular expression of each path, or nil.
+func matchPaths(paths []string, regexps []*regexp.Regexp, path string, repl *caddy.Replacer, opts *MatchOptions) (string, bool) {
+	for i, p := range paths {
+		if re := regexps[i]; re != nil {
+			if match := re.FindStringSubmatch(path); match != nil {
+				setPathGroups(repl, re, match)
+				return path, true
+			}
+			continue
+		}
+		p = opts.trim(repl.ReplaceAll(p, ""))
+		if opts.equal(p, path) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// protocolRoute returns the route of the first subprotocol offered by the client that
+// has one in ProtocolRoutes, or nil.
+func (m *WSHeartbeat) protocolRoute(offered []string) *BackendRoute {
+	for _, p := range offered {
+		for _, route := range m.routes {
+			if route.subprotocol == p {
+				return route
+			}
+		}
+	}
+	return nil
+}
+
+// hostRoute returns the route of HostRoutes matching the request host, or nil. An
+// exact pattern wins over a wildcard one, and "*." matches a single label.
+func (m *WSHeartbeat) hostRoute(host string) *BackendRoute {
+	host = normalizeHost(host)
+	for _, route := range m.routes {
+		if route.hostPattern != "" && route.hostPattern == host {
+			return route
+		}
+	}
+	for _, route := range m.routes {
+		if matchWildcardHost(route.hostPattern, host) {
+			return route
+		}
+	}
+	return nil
+}
+
+// normalizeHost returns host without its port, brackets and trailing dot, in lower
+// case.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(strings.TrimSuffix(host, "."), "[]"))
+}
+
+// matchWildcardHost reports whether the normalized host matches pattern "*.name",
+// which stands for a single label followed by name.
+func matchWildcardHost(pattern, host string) bool {
+	suffix, ok := strings.CutPrefix(pattern, "*")
+	if !ok {
+		return false
+	}
+	label, ok := strings.CutSuffix(host, suffix)
+	return ok && label != "" && !strings.Contains(label, ".")
+}
+
+// validHostPattern reports whether pattern is a hostname, optionally with a leading
+// "*." wildcard label.
+func validHostPattern(pattern string) bool {
+	name := strings.TrimPrefix(pattern, "*.")
+	return name != "" && !strings.ContainsAny(name, "*/:") && !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, ".")
+}
+
+// setPathGroups sets the groups of a backend path regular expression match as the
+// {ws.path.N} placeholders, and named groups also as {ws.path.name}.
+func setPathGroups(repl *caddy.Replacer, re *regexp.Regexp, match []string) {
+	for i, name := range re.SubexpNames() {
+		repl.Set("ws.path."+strconv.Itoa(i), match[i])
+		if name != "" {
+			repl.Set("ws.path."+name, match[i])
+		}
+	}
+}
+
+// hasScheme reports whether any route dials backends over scheme.
+func (m *WSHeartbeat) hasScheme(scheme string) bool {
+	if m.upstreamSource != nil && m.UpstreamsScheme == scheme {
+		return true
+	}
+	for _, route := range m.routes {
+		for _, up := range route.upstreams {
+			if up.target.scheme == scheme {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasSocket reports whether any route dials a unix socket.
+func (m *WSHeartbeat) hasSocket() bool {
+	for _, route := range m.routes {
+		for _, up := range route.upstreams {
+			if up.target.socket != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// backendTarget is a parsed backend address.
+type backendTarget struct {
+	// scheme is the websocket scheme ("ws" or "wss") used to dial the backend.
+	scheme string
+	// addr is the host[:port] put in the dial URL.
+	addr string
+	// basePath is prefixed to the request path when building the backend URL.
+	basePath string
+	// socket is the unix socket path to dial instead of addr, if any.
+	socket string
+	// srv reports whether addr is an SRV record name resolved at dial time.
+	srv bool
+}
+
+// parseBackendHost parses a backend host, which is either a bare host[:port] (dialed
+// over ws), a ws:// or wss:// URL with an optional base path, or a "unix/" socket path.
+// A "srv+" prefix marks the host as an SRV record name, e.g. "srv+_ws._tcp.app.internal".
+func parseBackendHost(host string) (backendTarget, error) {
+	if name, ok := strings.CutPrefix(host, "srv+"); ok {
+		t, err := parseBackendHost(name)
+		if err != nil {
+			return backendTarget{}, err
+		}
+		if t.socket != "" {
+			return backendTarget{}, fmt.Errorf("SRV backend cannot be a unix socket: %s", host)
+		}
+		if _, _, err := net.SplitHostPort(t.addr); err == nil {
+			return backendTarget{}, fmt.Errorf("SRV backend must not have a port: %s", host)
+		}
+		t.srv = true
+		return t, nil
+	}
+	// Unix sockets have no host; send "localhost" in the handshake instead.
+	if socket, ok := strings.CutPrefix(host, "unix/"); ok {
+		if socket == "" {
+			return backendTarget{}, fmt.Errorf("backend host has no socket path: %s", host)
+		}
+		return backendTarget{scheme: "ws", addr: "localhost", socket: socket}, nil
+	}
+	// A bare host[:port] is dialed over plain ws.
+	if !strings.Contains(host, "://") {
+		host = "ws://" + host
+	}
+	// Bracket IPv6 literals and escape their zones so they survive URL parsing.
+	scheme, rest, _ := strings.Cut(host, "://")
+	hostport, path, hasPath := strings.Cut(rest, "/")
+	host = scheme + "://" + normalizeIPv6(hostport)
+	if hasPath {
+		host += "/" + path
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return backendTarget{}, fmt.Errorf("invalid backend host %s: %v", host, err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return backendTarget{}, fmt.Errorf("unsupported backend scheme %q in %s: must be ws or wss", u.Scheme, host)
+	}
+	if u.Hostname() == "" {
+		return backendTarget{}, fmt.Errorf("backend host has no address: %s", host)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return backendTarget{}, fmt.Errorf("backend host must not contain user info, query or fragment: %s", host)
+	}
+	return backendTarget{
+		scheme:   u.Scheme,
+		addr:     u.Host,
+		basePath: strings.TrimSuffix(u.EscapedPath(), "/"),
+	}, nil
+}
+
+// placeholderRegexp matches a single Caddy placeholder such as {http.request.host}.
+var placeholderRegexp = regexp.MustCompile(`\{[^{}\s]+\}`)
+
+// hasPlaceholders reports whether s contains Caddy placeholders.
+func hasPlaceholders(s string) bool {
+	return placeholderRegexp.MatchString(s)
+}
+
+// stubPlaceholders replaces each placeholder in s with a fixed host label, so that the
+// static portions of a dynamic value can be validated ahead of time.
+func stubPlaceholders(s string) string {
+	return placeholderRegexp.ReplaceAllString(s, "placeholder")
+}
+
+// normalizeIPv6 brackets a bare IPv6 literal (optionally with a zone) and escapes the
+// zone separator as "%25", as required in URLs. Other hosts are returned unchanged.
+func normalizeIPv6(hostport string) string {
+	if strings.HasPrefix(hostport, "[") {
+		// Bracketed literal, possibly with an unescaped zone: "[fe80::1%eth0]:9000".
+		end := strings.Index(hostport, "]")
+		if end < 0 {
+			return hostport
+		}
+		literal := hostport[1:end]
+		if i := strings.Index(literal, "%"); i >= 0 && !strings.HasPrefix(literal[i:], "%25") {
+			literal = literal[:i] + "%25" + literal[i+1:]
+		}
+		return "[" + literal + "]" + hostport[end+1:]
+	}
+	// Bare literal without a port: "fd00::12" or "fe80::1%eth0".
+	ip, zone, _ := strings.Cut(hostport, "%")
+	if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() != nil {
+		return hostport
+	}
+	if zone != "" {
+		ip += "%25" + strings.TrimPrefix(zone, "25")
+	}
+	return "[" + ip + "]"
+}
+
+// resolve returns the concrete targets to try, in order, for t.
+func (m *WSHeartbeat) resolve(ctx context.Context, t backendTarget) ([]backendTarget, error) {
+	if t.srv {
+		return m.srvTargets(ctx, t)
+	}
+	return []backendTarget{t}, nil
+}
+
+// hostHeader returns the Host header to send to the backend. It is the dialed
+// address without any IPv6 zone, which must not appear in the Host header.
+func (t backendTarget) hostHeader() string {
+	host, port, err := net.SplitHostPort(t.addr)
+	if err != nil {
+		// No port: strip brackets for the zone check, then put them back.
+		host, port = strings.TrimSuffix(strings.TrimPrefix(t.addr, "["), "]"), ""
+	}
+	if i := strings.Index(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	if port == "" {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// url builds the backend websocket URL for the (possibly rewritten) request URL u.
+func (t backendTarget) url(u *url.URL) string {
+	// Re-escape an IPv6 zone separator, which url.Parse unescaped.
+	addr := t.addr
+	if i := strings.Index(addr, "%"); i >= 0 {
+		addr = addr[:i] + "%25" + addr[i+1:]
+	}
+	return t.scheme + "://" + addr + t.basePath + u.RequestURI()
+}
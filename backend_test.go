@@ -0,0 +1,70 @@
+package wsheartbeat
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseBackendHostIPv6(t *testing.T) {
+	request, _ := url.Parse("/ws?a=1")
+	tests := []struct {
+		host string
+		// url is the backend URL of the request, hostname and port how it is dialed,
+		// and hostHeader the Host sent in the handshake.
+		url, hostname, port, hostHeader string
+	}{
+		{"[fd00::12]:9000", "ws://[fd00::12]:9000/ws?a=1", "fd00::12", "9000", "[fd00::12]:9000"},
+		{"ws://[::1]:8080", "ws://[::1]:8080/ws?a=1", "::1", "8080", "[::1]:8080"},
+		// Without a port, the default port of the scheme is dialed.
+		{"fd00::12", "ws://[fd00::12]/ws?a=1", "fd00::12", "", "[fd00::12]"},
+		{"[fd00::12]", "ws://[fd00::12]/ws?a=1", "fd00::12", "", "[fd00::12]"},
+		{"wss://[fd00::12]/base", "wss://[fd00::12]/base/ws?a=1", "fd00::12", "", "[fd00::12]"},
+		// Zones are escaped in the URL, whether or not they were, and never sent in the
+		// Host header.
+		{"fe80::1%eth0", "ws://[fe80::1%25eth0]/ws?a=1", "fe80::1%eth0", "", "[fe80::1]"},
+		{"fe80::1%25eth0", "ws://[fe80::1%25eth0]/ws?a=1", "fe80::1%eth0", "", "[fe80::1]"},
+		{"[fe80::1%eth0]:9000", "ws://[fe80::1%25eth0]:9000/ws?a=1", "fe80::1%eth0", "9000", "[fe80::1]:9000"},
+		{"[fe80::1%25eth0]:9000", "ws://[fe80::1%25eth0]:9000/ws?a=1", "fe80::1%eth0", "9000", "[fe80::1]:9000"},
+		// Other hosts are left alone.
+		{"127.0.0.1:9000", "ws://127.0.0.1:9000/ws?a=1", "127.0.0.1", "9000", "127.0.0.1:9000"},
+		{"example.com", "ws://example.com/ws?a=1", "example.com", "", "example.com"},
+	}
+	for _, tt := range tests {
+		target, err := parseBackendHost(tt.host)
+		if err != nil {
+			t.Errorf("parseBackendHost(%q): %v", tt.host, err)
+			continue
+		}
+		backendURL := target.url(request)
+		if backendURL != tt.url {
+			t.Errorf("parseBackendHost(%q): url = %q, want %q", tt.host, backendURL, tt.url)
+		}
+		// The URL must parse back to the dialed address, as the websocket dialer does.
+		u, err := url.Parse(backendURL)
+		if err != nil {
+			t.Errorf("parseBackendHost(%q): url %q doesn't parse: %v", tt.host, backendURL, err)
+		} else if u.Hostname() != tt.hostname || u.Port() != tt.port {
+			t.Errorf("parseBackendHost(%q): dials %q port %q, want %q port %q", tt.host, u.Hostname(), u.Port(), tt.hostname, tt.port)
+		}
+		if got := target.hostHeader(); got != tt.hostHeader {
+			t.Errorf("parseBackendHost(%q): Host header = %q, want %q", tt.host, got, tt.hostHeader)
+		}
+	}
+}
+
+func TestNormalizeIPv6(t *testing.T) {
+	tests := map[string]string{
+		"fd00::12":            "[fd00::12]",
+		"fe80::1%eth0":        "[fe80::1%25eth0]",
+		"[fe80::1%eth0]:9000": "[fe80::1%25eth0]:9000",
+		"[fd00::12]:9000":     "[fd00::12]:9000",
+		"127.0.0.1:9000":      "127.0.0.1:9000",
+		"example.com:9000":    "example.com:9000",
+		"[fd00::12":           "[fd00::12",
+	}
+	for in, want := range tests {
+		if got := normalizeIPv6(in); got != want {
+			t.Errorf("normalizeIPv6(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package wsheartbeat
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker is a per-upstream circuit breaker fed by backend dial results. After
+// threshold consecutive failures it opens for a cool-down period, then lets a single
+// probe dial through (half-open) whose result closes or re-opens it.
+type breaker struct {
+	// mu protects the fields below.
+	mu sync.Mutex
+	// failures is the number of consecutive dial failures.
+	failures int
+	// openUntil is when the open breaker becomes half-open; zero while closed.
+	openUntil time.Time
+	// probing reports whether a half-open probe dial is in flight.
+	probing bool
+	// trips counts how many times the breaker has opened.
+	trips int
+}
+
+// eligible reports whether a dial could currently be attempted, without claiming it.
+func (b *breaker) eligible(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.openUntil.IsZero() || (!now.Before(b.openUntil) && !b.probing)
+}
+
+// allow reports whether a dial may be attempted now. In the half-open state only
+// the first caller is allowed, as the probe: probe is then true, and the caller must
+// either record the result of its dial or abort the probe.
+func (b *breaker) allow(now time.Time) (ok, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.openUntil.IsZero():
+		return true, false
+	case now.Before(b.openUntil) || b.probing:
+		return false, false
+	default:
+		b.probing = true
+		return true, true
+	}
+}
+
+// abortProbe gives up the half-open probe claimed by allow without a result, such as
+// when the client went away, so that the next dial can probe instead.
+func (b *breaker) abortProbe() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// record feeds a dial result into the breaker and reports the resulting state
+// change: opened is true when the breaker just opened, closed when it just closed.
+// probe tells whether the dial was the half-open probe. Other failures while the
+// breaker is open come from dials in flight when it opened, and are ignored.
+func (b *breaker) record(success, probe bool, threshold int, openFor time.Duration, now time.Time) (opened, closed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen := !b.openUntil.IsZero()
+	if success {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		b.probing = false
+		return false, wasOpen
+	}
+	if wasOpen && !probe {
+		return false, false
+	}
+	b.probing = false
+	b.failures++
+	if wasOpen || b.failures >= threshold {
+		b.openUntil = now.Add(openFor)
+		b.trips++
+		return true, false
+	}
+	return false, false
+}
+
+// open reports whether the breaker is open or half-open.
+func (b *breaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero()
+}
+
+// counts returns the consecutive failures and the number of trips.
+func (b *breaker) counts() (failures, trips int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures, b.trips
+}
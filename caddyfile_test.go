@@ -0,0 +1,56 @@
+package wsheartbeat
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"strings"
+	"testing"
+)
+
+// adaptedOrder adapts the Caddyfile input and reports whether the ws_heartbeat handler
+// comes before reverse_proxy in the resulting routes.
+func adaptedOrder(t *testing.T, input string) (wsFirst bool) {
+	t.Helper()
+	out, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(input), nil)
+	if err != nil {
+		t.Fatalf("adapting: %v", err)
+	}
+	ws := strings.Index(string(out), `"handler":"ws_heartbeat"`)
+	proxy := strings.Index(string(out), `"handler":"reverse_proxy"`)
+	if ws < 0 || proxy < 0 {
+		t.Fatalf("adapted config lacks a handler: %s", out)
+	}
+	return ws < proxy
+}
+
+func TestAdaptWithoutOrder(t *testing.T) {
+	// ws_heartbeat comes after reverse_proxy in the site block, without any global
+	// order option.
+	input := `:8080 {
+	reverse_proxy 127.0.0.1:9001
+	ws_heartbeat {
+		interval 5s
+		backend 127.0.0.1:9000 /ws
+	}
+}
+`
+	if !adaptedOrder(t, input) {
+		t.Fatal("ws_heartbeat isn't ordered before reverse_proxy by default")
+	}
+}
+
+func TestAdaptHonorsExplicitOrder(t *testing.T) {
+	input := `{
+	order ws_heartbeat after reverse_proxy
+}
+
+:8080 {
+	ws_heartbeat {
+		backend 127.0.0.1:9000 /ws
+	}
+	reverse_proxy 127.0.0.1:9001
+}
+`
+	if adaptedOrder(t, input) {
+		t.Fatal("the global order option isn't honored")
+	}
+}
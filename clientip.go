@@ -0,0 +1,113 @@
+package wsheartbeat
+
+import (
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// provisionTrustedProxies parses TrustedProxies, expanding "private_ranges" to the
+// private networks like Caddy does.
+func (m *WSHeartbeat) provisionTrustedProxies() error {
+	var networks []string
+	for _, network := range m.TrustedProxies {
+		if network == "private_ranges" {
+			networks = append(networks, caddyhttp.PrivateRangesCIDR()...)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	prefixes, err := parsePrefixes(networks)
+	if err != nil {
+		return err
+	}
+	m.trustedProxies = prefixes
+	return nil
+}
+
+// peerIP returns the IP of the immediate peer of r, without port or zone.
+func peerIP(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.WithZone("").Unmap(), true
+}
+
+// trustedProxy reports whether addr is in TrustedProxies.
+func (m *WSHeartbeat) trustedProxy(addr netip.Addr) bool {
+	return slices.ContainsFunc(m.trustedProxies, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+}
+
+// trustedPeer reports whether the immediate peer of r is a trusted proxy, whose
+// forwarded headers may be believed: one of TrustedProxies when set, or else of the
+// server's trusted proxies.
+func (m *WSHeartbeat) trustedPeer(r *http.Request) bool {
+	if len(m.trustedProxies) == 0 {
+		trusted, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool)
+		return trusted
+	}
+	addr, ok := peerIP(r)
+	return ok && m.trustedProxy(addr)
+}
+
+// clientIP returns the real client IP of r. With TrustedProxies, it is the rightmost
+// entry of X-Forwarded-For that isn't a trusted proxy, when the immediate peer is one,
+// like Caddy's strict mode. Otherwise Caddy resolves it with the server's trusted
+// proxies, and it is the remote address when the peer isn't one of them.
+func (m *WSHeartbeat) clientIP(r *http.Request) string {
+	if len(m.trustedProxies) > 0 {
+		addr, ok := peerIP(r)
+		if !ok {
+			return r.RemoteAddr
+		}
+		if !m.trustedProxy(addr) {
+			return addr.String()
+		}
+		parts := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(parts) - 1; i >= 0; i-- {
+			// Some proxies keep the port.
+			host, _, err := net.SplitHostPort(strings.TrimSpace(parts[i]))
+			if err != nil {
+				host = strings.TrimSpace(parts[i])
+			}
+			host, _, _ = strings.Cut(host, "%")
+			hop, err := netip.ParseAddr(host)
+			if err != nil {
+				continue
+			}
+			if hop = hop.Unmap(); !m.trustedProxy(hop) {
+				return hop.String()
+			}
+		}
+		return addr.String()
+	}
+	if ip, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string); ok && ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientTLS reports whether the client connection of r is TLS: either its own, or
+// the one a trusted proxy says it received with X-Forwarded-Proto.
+func (m *WSHeartbeat) clientTLS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if !m.trustedPeer(r) {
+		return false
+	}
+	values := r.Header.Values("X-Forwarded-Proto")
+	return len(values) > 0 && strings.EqualFold(strings.TrimSpace(values[len(values)-1]), "https")
+}
@@ -0,0 +1,32 @@
+package wsheartbeat
+
+import "time"
+
+// timer is a timer of the ping loop: a *time.Timer, except with the fake clock of
+// tests, which fire it at will.
+type timer interface {
+	// C returns the channel the timer fires on.
+	C() <-chan time.Time
+	// Reset rearms the timer to fire after d.
+	Reset(d time.Duration) bool
+	// Stop stops the timer.
+	Stop() bool
+}
+
+// realTimer is a timer of the system clock.
+type realTimer struct {
+	*time.Timer
+}
+
+// C returns the channel of the timer.
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// newTimer returns a timer of the ping loop firing after d.
+func (m *WSHeartbeat) newTimer(d time.Duration) timer {
+	if m.timers != nil {
+		return m.timers(d)
+	}
+	return realTimer{time.NewTimer(d)}
+}
@@ -0,0 +1,392 @@
+package wsheartbeat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// maxDialRetryBackoff caps the wait between two backend dial attempts.
+const maxDialRetryBackoff = 5 * time.Second
+
+// maxRejectionBody caps the body of a rejected backend handshake relayed to the client.
+const maxRejectionBody = 4096
+
+// handshakeRejection is the error of a backend that answered the handshake with
+// another status than 101 Switching Protocols, e.g. when it refused to authenticate
+// the client. The answer is relayed to the client.
+type handshakeRejection struct {
+	// resp is the backend's response, with its body closed.
+	resp *http.Response
+	// body is the start of the response body, up to maxRejectionBody bytes.
+	body []byte
+}
+
+// Error describes the rejection.
+func (e *handshakeRejection) Error() string {
+	return fmt.Sprintf("backend rejected the websocket handshake with status %d", e.resp.StatusCode)
+}
+
+// connectBackend dials a backend of route for the client request r. The upstreams
+// picked by the load balancing policy are tried in order until one accepts the
+// connection. A backend refusing the client with a status below 500 is final; one
+// failing with a 5xx is skipped, and its answer relayed only when no other upstream
+// accepts the connection. forwardURL is the (possibly rewritten) URL to request from the backend.
+// Returned errors are ready to be returned from ServeHTTP. The backend's handshake
+// response is returned along with the connection.
+// On success the upstream's connection count has been incremented; the caller must
+// decrement it once the proxied connection is closed.
+func (m *WSHeartbeat) connectBackend(r *http.Request, route *BackendRoute, forwardURL *url.URL, subprotocols []string, reqHeader http.Header) (*websocket.Conn, *http.Response, *upstream, error) {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	logger := m.requestLogger(r)
+
+	// Determine the Host header sent to the backend, if overridden.
+	var hostHeader string
+	switch {
+	case m.PreserveHost || m.HostHeader == "preserve":
+		hostHeader = r.Host
+	case m.HostHeader != "":
+		hostHeader = repl.ReplaceAll(m.HostHeader, "")
+	}
+
+	// Use a copy of the template dialer, passing the offered subprotocols.
+	dialer := m.dialer
+	dialer.Subprotocols = subprotocols
+
+	// Ask the dynamic upstream source, falling back to the static hosts when it has none.
+	ups := route.upstreams
+	if route.dynamic {
+		sourced, err := m.dynamicUpstreams(r)
+		if err != nil {
+			logger.Error("dynamic upstreams error", zap.Error(err))
+			return nil, nil, nil, caddyhttp.Error(http.StatusServiceUnavailable, err)
+		}
+		if len(sourced) > 0 {
+			ups = sourced
+		}
+	}
+
+	// Fail fast when every upstream is down or has its circuit breaker open.
+	candidates := m.selectUpstreams(route, ups, r)
+	if len(candidates) == 0 {
+		logger.Warn("no backend available", zap.Strings("backend_host", route.BackendHost))
+		return nil, nil, nil, caddyhttp.Error(http.StatusServiceUnavailable,
+			fmt.Errorf("no backend available for %s", route.BackendHost))
+	}
+
+	var err error = caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("no backend available for %s", route.BackendHost))
+	// failed is the last 5xx answer of a backend, relayed once every upstream failed.
+	var failed error
+	for i, up := range candidates {
+		ok, probe := m.claimUpstream(up)
+		if !ok {
+			continue
+		}
+		var backendConn *websocket.Conn
+		var resp *http.Response
+		backendConn, resp, err = m.dialUpstream(r, up, &dialer, forwardURL, hostHeader, reqHeader)
+		// A backend refusing the client itself, rather than failing, is healthy.
+		dialErr := err
+		var rejection *handshakeRejection
+		if errors.As(err, &rejection) && rejection.resp.StatusCode < http.StatusInternalServerError {
+			dialErr = nil
+		}
+		m.recordDial(r, up, probe, dialErr)
+		if err != nil {
+			up.conns.Add(-1)
+			// The refusal of the client is final; a failing backend is skipped.
+			if rejection != nil && dialErr == nil {
+				return nil, nil, nil, err
+			}
+			if rejection != nil {
+				failed = err
+			}
+		} else {
+			logger.Debug("connected to backend",
+				zap.String("path", r.URL.Path),
+				zap.String("upstream", up.host),
+				zap.Int("skipped", i),
+			)
+			return backendConn, resp, up, nil
+		}
+	}
+	if failed != nil {
+		return nil, nil, nil, failed
+	}
+	return nil, nil, nil, err
+}
+
+// claimUpstream counts a connection dialing up, and claims its half-open probe if its
+// circuit breaker is half-open. It fails when up reached its connection cap, or when
+// another connection claimed the probe, in the meantime. The connection is counted
+// before the probe is claimed, so that a claimed probe is always either recorded or
+// aborted by recordDial.
+func (m *WSHeartbeat) claimUpstream(up *upstream) (ok, probe bool) {
+	if !up.acquire(m.MaxConnsPerUpstream) {
+		return false, false
+	}
+	if m.failDurationValue == 0 {
+		return true, false
+	}
+	if ok, probe = up.breaker.allow(time.Now()); !ok {
+		up.conns.Add(-1)
+	}
+	return ok, probe
+}
+
+// recordDial feeds the result of dialing up into its circuit breaker, logging when the
+// breaker opens or closes. Dials aborted by the client don't count; a half-open probe
+// among them is given up, so that the next dial probes instead.
+func (m *WSHeartbeat) recordDial(r *http.Request, up *upstream, probe bool, err error) {
+	if m.failDurationValue == 0 {
+		return
+	}
+	if r.Context().Err() != nil {
+		if probe {
+			up.breaker.abortProbe()
+		}
+		return
+	}
+	opened, closed := up.breaker.record(err == nil, probe, m.MaxFails, m.failDurationValue, time.Now())
+	failures, trips := up.breaker.counts()
+	switch {
+	case opened:
+		m.logger.Warn("circuit breaker opened, taking backend out of rotation",
+			zap.String("upstream", up.host),
+			zap.Int("consecutive_failures", failures),
+			zap.Int("trips", trips),
+			zap.Duration("open_for", m.failDurationValue),
+		)
+		m.markedDown(up)
+	case closed:
+		m.logger.Info("circuit breaker closed, backend back in rotation",
+			zap.String("upstream", up.host),
+			zap.Int("trips", trips),
+		)
+	}
+}
+
+// dialUpstream dials the upstream up, trying each of its resolved targets in order
+// until one accepts the connection, and returns its handshake response. A target
+// refusing the client with a status below 500 is final; the last 5xx answer is
+// returned once every target failed.
+func (m *WSHeartbeat) dialUpstream(r *http.Request, up *upstream, dialer *websocket.Dialer, forwardURL *url.URL, hostHeader string, reqHeader http.Header) (*websocket.Conn, *http.Response, error) {
+	logger := m.requestLogger(r)
+	// Expand placeholders in the upstream host.
+	target := up.target
+	if up.dynamic {
+		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		host := repl.ReplaceAll(up.host, "")
+		var err error
+		target, err = parseBackendHost(host)
+		if err != nil {
+			logger.Error("invalid backend host after placeholder expansion",
+				zap.String("backend_host", up.host),
+				zap.String("expanded", host),
+				zap.Error(err),
+			)
+			return nil, nil, caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+	}
+
+	// Resolve the upstream into the concrete targets to try.
+	targets, err := m.resolve(r.Context(), target)
+	if err != nil {
+		logger.Error("resolve backend error", zap.String("backend_host", up.host), zap.Error(err))
+		return nil, nil, caddyhttp.Error(http.StatusServiceUnavailable, err)
+	}
+
+	// failed is the last 5xx answer of a target.
+	var failed *handshakeRejection
+	for _, target := range targets {
+		// Construct the backend websocket URL.
+		backendURL := target.url(forwardURL)
+		targetDialer := m.targetDialer(dialer, target, hostHeader, reqHeader)
+		var backendConn *websocket.Conn
+		var resp *http.Response
+		backendConn, resp, err = m.dialBackend(r, &targetDialer, backendURL, reqHeader)
+		if err == nil {
+			return backendConn, resp, nil
+		}
+		// Keep the answer of a backend refusing the upgrade for the client.
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, maxRejectionBody))
+			_ = resp.Body.Close()
+			logger.Debug("backend rejected websocket handshake",
+				zap.String("backend_url", backendURL),
+				zap.Int("status", resp.StatusCode),
+			)
+			rejection := &handshakeRejection{resp: resp, body: body}
+			if resp.StatusCode < http.StatusInternalServerError {
+				return nil, nil, rejection
+			}
+			failed = rejection
+			continue
+		}
+		fields := []zap.Field{zap.String("backend_url", backendURL), zap.Error(err)}
+		if m.forwardProxyURL != nil {
+			fields = append(fields, zap.String("forward_proxy", m.forwardProxyURL.Redacted()))
+		}
+		logger.Error("dial backend error", fields...)
+	}
+	if failed != nil {
+		return nil, nil, failed
+	}
+	if err == nil {
+		err = fmt.Errorf("no backend targets for %s", up.host)
+	}
+	return nil, nil, caddyhttp.Error(http.StatusServiceUnavailable, err)
+}
+
+// targetDialer returns a copy of dialer for target, and sets the Host header of its
+// handshake in header: the overridden hostHeader, if any, or else the dialed address
+// without any IPv6 zone. SNI follows tls_server_name, then hostHeader, then the
+// dialed host.
+func (m *WSHeartbeat) targetDialer(dialer *websocket.Dialer, target backendTarget, hostHeader string, header http.Header) websocket.Dialer {
+	header.Del("Host")
+	if hostHeader != "" {
+		header.Set("Host", hostHeader)
+	} else if host := target.hostHeader(); host != target.addr {
+		header.Set("Host", host)
+	}
+	targetDialer := *dialer
+	if target.socket != "" {
+		targetDialer.NetDialContext = unixDialer(target.socket)
+	}
+	if target.scheme == "wss" && m.TLSServerName == "" && hostHeader != "" {
+		targetDialer.TLSClientConfig = withServerName(targetDialer.TLSClientConfig, hostHeader)
+	}
+	return targetDialer
+}
+
+// dialBackend connects to the backend, retrying failed dials with exponential backoff
+// for as long as retries remain and the client's request is still alive.
+// Cancelling the client's request also cancels an in-flight dial.
+func (m *WSHeartbeat) dialBackend(r *http.Request, dialer *websocket.Dialer, backendURL string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	backoff := m.dialRetryIntervalDuration
+	logger := m.requestLogger(r)
+	for attempt := 0; ; attempt++ {
+		dialCtx, cancel := context.WithTimeout(r.Context(), m.dialTimeoutDuration)
+		conn, resp, err := dialAbortable(dialCtx, dialer, backendURL, header)
+		cancel()
+		// Don't hand out a backend connection for a client that has already gone away.
+		if err == nil && r.Context().Err() != nil {
+			_ = conn.Close()
+			return nil, resp, r.Context().Err()
+		}
+		// Stop on success, when the backend answered the handshake, or when out of retries.
+		if err == nil || resp != nil || attempt >= m.DialRetries {
+			return conn, resp, err
+		}
+		logger.Debug("dial backend failed, retrying",
+			zap.String("backend_url", backendURL),
+			zap.Int("attempt", attempt+1),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+		// Wait for the backoff, giving up early if the client goes away.
+		timer := time.NewTimer(backoff)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, nil, err
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, maxDialRetryBackoff)
+	}
+}
+
+// dialAbortable dials backendURL with dialer, aborting the handshake as soon as ctx
+// is done. gorilla/websocket only applies the deadline of ctx to the handshake, so a
+// client going away would otherwise leave it running until the dial timeout.
+func dialAbortable(ctx context.Context, dialer *websocket.Dialer, backendURL string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	netDial := dialer.NetDialContext
+	if netDial == nil {
+		var d net.Dialer
+		netDial = d.DialContext
+	}
+	var stop func() bool
+	abortable := *dialer
+	abortable.NetDialContext = func(dialCtx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := netDial(dialCtx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		// Unblock the handshake by expiring the deadline of its connection. The dial
+		// context isn't used, as gorilla/websocket cancels it when the dial returns.
+		stop = context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+		return conn, nil
+	}
+	conn, resp, err := abortable.DialContext(ctx, backendURL, header)
+	if stop != nil && !stop() && err == nil {
+		// The handshake completed as ctx ended, leaving the connection expired.
+		_ = conn.Close()
+		return nil, resp, ctx.Err()
+	}
+	return conn, resp, err
+}
+
+// unixDialer returns a dial function that connects to the unix socket at path,
+// whatever address the websocket dialer asks for.
+func unixDialer(path string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+}
+
+// provisionForwardProxy routes backend dials through the configured HTTP CONNECT or SOCKS5 proxy.
+func (m *WSHeartbeat) provisionForwardProxy() error {
+	proxyURL, err := url.Parse(m.ForwardProxy)
+	if err != nil {
+		return fmt.Errorf("invalid forward proxy: %v", err)
+	}
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "socks5" {
+		return fmt.Errorf("unsupported forward proxy scheme %q: must be http or socks5", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return fmt.Errorf("forward proxy has no host: %s", proxyURL.Redacted())
+	}
+	if m.hasSocket() {
+		return fmt.Errorf("forward_proxy cannot be used with a unix socket backend")
+	}
+	m.forwardProxyURL = proxyURL
+	// Credentials in the URL are used for basic (http) or username/password (socks5) auth.
+	m.dialer.Proxy = http.ProxyURL(proxyURL)
+	// The net dialer only ever connects to the proxy, so tag its failures to tell them
+	// apart from errors reported by the backend.
+	redacted := proxyURL.Redacted()
+	m.dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("forward proxy %s: %w", redacted, err)
+		}
+		return conn, nil
+	}
+	return nil
+}
+
+// relayRejection answers the client with the status, end-to-end headers and body of
+// a backend that rejected the handshake.
+func relayRejection(w http.ResponseWriter, rejection *handshakeRejection) error {
+	for name, values := range rejection.resp.Header {
+		// The body may have been cut short.
+		if !copyableHeader(rejection.resp, name) || name == "Content-Length" {
+			continue
+		}
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.WriteHeader(rejection.resp.StatusCode)
+	_, err := w.Write(rejection.body)
+	return err
+}
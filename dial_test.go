@@ -0,0 +1,258 @@
+package wsheartbeat
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sendUpgrade sends a websocket upgrade for path to proxy over a raw connection, so
+// that the test can drop it mid-handshake.
+func sendUpgrade(t *testing.T, proxy *httptest.Server, path string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", path, conn.RemoteAddr())
+	return conn
+}
+
+func TestClientGoneAbortsBackendDial(t *testing.T) {
+	// The backend never answers the handshake, and notes when the proxy hangs up.
+	handshaking := make(chan struct{})
+	hungUp := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(handshaking)
+		<-r.Context().Done()
+		close(hungUp)
+	}))
+	t.Cleanup(backend.Close)
+
+	m := &WSHeartbeat{DialTimeout: "1m"}
+	proxy := serveProxy(t, m, backend)
+	client := sendUpgrade(t, proxy, "/ws")
+	<-handshaking
+	_ = client.Close()
+
+	select {
+	case <-hungUp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend connection left open after the client went away")
+	}
+	up := m.routes[0].upstreams[0]
+	waitFor(t, "the dial to be uncounted", func() bool { return up.conns.Load() == 0 })
+}
+
+// halfOpen puts the circuit breaker of up in its half-open state.
+func halfOpen(up *upstream) {
+	up.breaker.mu.Lock()
+	defer up.breaker.mu.Unlock()
+	up.breaker.failures = 1
+	up.breaker.openUntil = time.Now().Add(-time.Second)
+}
+
+func TestClaimUpstreamAtCapKeepsProbe(t *testing.T) {
+	m := &WSHeartbeat{
+		BackendHost:         HostList{"127.0.0.1:1"},
+		BackendPaths:        []string{"/ws"},
+		FailDuration:        "1m",
+		MaxFails:            1,
+		MaxConnsPerUpstream: 1,
+	}
+	provisionTest(t, m)
+	up := m.routes[0].upstreams[0]
+	halfOpen(up)
+
+	// An upstream at its cap must not claim the probe it can't dial.
+	up.conns.Store(1)
+	if ok, _ := m.claimUpstream(up); ok {
+		t.Fatal("claimed an upstream at its connection cap")
+	}
+	if got := up.conns.Load(); got != 1 {
+		t.Fatalf("conns = %d after a failed claim, want 1", got)
+	}
+	if !up.breaker.eligible(time.Now()) {
+		t.Fatal("failed claim left the half-open probe claimed")
+	}
+
+	up.conns.Store(0)
+	if ok, probe := m.claimUpstream(up); !ok || !probe {
+		t.Fatalf("claimUpstream = %v, %v; want the probe", ok, probe)
+	}
+	if ok, _ := m.claimUpstream(up); ok {
+		t.Fatal("claimed the half-open probe twice")
+	}
+}
+
+func TestClientAbortReleasesProbe(t *testing.T) {
+	// The backend holds the handshake until the proxy hangs up.
+	handshaking := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handshaking <- struct{}{}
+		<-r.Context().Done()
+	}))
+	t.Cleanup(backend.Close)
+
+	m := &WSHeartbeat{FailDuration: "1m", MaxFails: 1, DialTimeout: "1m"}
+	proxy := serveProxy(t, m, backend)
+	up := m.routes[0].upstreams[0]
+	halfOpen(up)
+
+	client := sendUpgrade(t, proxy, "/ws")
+	<-handshaking
+	if up.breaker.eligible(time.Now()) {
+		t.Fatal("probe dial in flight without claiming the probe")
+	}
+	_ = client.Close()
+
+	waitFor(t, "the probe to be released", func() bool {
+		return up.conns.Load() == 0 && up.breaker.eligible(time.Now())
+	})
+	if !up.breaker.open() {
+		t.Fatal("aborted probe changed the state of the breaker")
+	}
+}
+
+func TestBreakerIgnoresStaleFailures(t *testing.T) {
+	var b breaker
+	now := time.Now()
+	if opened, _ := b.record(false, false, 2, time.Minute, now); opened {
+		t.Fatal("opened below the threshold")
+	}
+	if opened, _ := b.record(false, false, 2, time.Minute, now); !opened {
+		t.Fatal("didn't open at the threshold")
+	}
+	openUntil := b.openUntil
+
+	// Dials in flight when the breaker opened fail later without re-opening it.
+	if opened, _ := b.record(false, false, 2, time.Minute, now.Add(time.Second)); opened {
+		t.Fatal("a stale failure re-opened the breaker")
+	}
+	if _, trips := b.counts(); trips != 1 || !b.openUntil.Equal(openUntil) {
+		t.Fatalf("trips = %d, open until %v after a stale failure; want 1 and %v", trips, b.openUntil, openUntil)
+	}
+
+	// Nor do they release the half-open probe.
+	halfOpenAt := openUntil.Add(time.Second)
+	if ok, probe := b.allow(halfOpenAt); !ok || !probe {
+		t.Fatalf("allow = %v, %v once half-open; want the probe", ok, probe)
+	}
+	b.record(false, false, 2, time.Minute, halfOpenAt)
+	if b.eligible(halfOpenAt) {
+		t.Fatal("a stale failure released the probe")
+	}
+
+	// The probe failing re-opens it.
+	if opened, _ := b.record(false, true, 2, time.Minute, halfOpenAt); !opened {
+		t.Fatal("a failed probe didn't re-open the breaker")
+	}
+	if _, trips := b.counts(); trips != 2 {
+		t.Fatalf("trips = %d after a failed probe, want 2", trips)
+	}
+	// And the next one succeeding closes it.
+	probeAt := halfOpenAt.Add(2 * time.Minute)
+	if ok, probe := b.allow(probeAt); !ok || !probe {
+		t.Fatalf("allow = %v, %v once half-open again; want the probe", ok, probe)
+	}
+	if _, closed := b.record(true, true, 2, time.Minute, probeAt); !closed || b.open() {
+		t.Fatal("a successful probe didn't close the breaker")
+	}
+}
+
+func TestBackendHostHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *WSHeartbeat
+		// want is the Host seen by the backend; "" stands for the backend address.
+		want string
+	}{
+		{"default", &WSHeartbeat{}, ""},
+		{"preserve_host", &WSHeartbeat{PreserveHost: true}, "chat.example.com"},
+		{"host_header", &WSHeartbeat{HostHeader: "internal.example.com"}, "internal.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := make(chan string, 1)
+			backend := echoBackend(t, func(r *http.Request) { hosts <- r.Host })
+			proxy := serveProxy(t, tt.m, backend)
+			conn, _, err := dialProxy(t, proxy, "/ws", http.Header{"Host": {"chat.example.com"}})
+			if err != nil {
+				t.Fatalf("dialing: %v", err)
+			}
+			defer conn.Close()
+			want := tt.want
+			if want == "" {
+				want = strings.TrimPrefix(backend.URL, "http://")
+			}
+			if got := <-hosts; got != want {
+				t.Fatalf("backend saw Host %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// statusBackend starts a backend answering every handshake with status, counting them.
+func statusBackend(t *testing.T, status int, hits *atomic.Int32) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, http.StatusText(status), status)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestFailoverOnBackendError(t *testing.T) {
+	tests := []struct {
+		name             string
+		primary, standby int
+		// want is the status the client gets, or 101 when it reaches the standby.
+		want int
+		// standbyDialed reports whether the standby is tried.
+		standbyDialed bool
+	}{
+		{"5xx fails over", http.StatusServiceUnavailable, http.StatusSwitchingProtocols, http.StatusSwitchingProtocols, true},
+		{"last 5xx relayed", http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusServiceUnavailable, true},
+		{"refusal final", http.StatusForbidden, http.StatusSwitchingProtocols, http.StatusForbidden, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var primaryHits, standbyHits atomic.Int32
+			primary := statusBackend(t, tt.primary, &primaryHits)
+			var standby *httptest.Server
+			if tt.standby == http.StatusSwitchingProtocols {
+				standby = echoBackend(t, func(*http.Request) { standbyHits.Add(1) })
+			} else {
+				standby = statusBackend(t, tt.standby, &standbyHits)
+			}
+			m := &WSHeartbeat{LBPolicy: "first", BackendHost: HostList{
+				strings.TrimPrefix(primary.URL, "http://"),
+				strings.TrimPrefix(standby.URL, "http://"),
+			}}
+			proxy := serveProxy(t, m, nil)
+
+			conn, resp, err := dialProxy(t, proxy, "/ws", nil)
+			if conn != nil {
+				conn.Close()
+			}
+			if resp == nil {
+				t.Fatalf("dialing: %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if primaryHits.Load() != 1 || (standbyHits.Load() == 1) != tt.standbyDialed {
+				t.Fatalf("primary dialed %d times, standby %d times; want 1 and standby dialed %v",
+					primaryHits.Load(), standbyHits.Load(), tt.standbyDialed)
+			}
+		})
+	}
+}
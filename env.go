@@ -0,0 +1,53 @@
+package wsheartbeat
+
+import (
+	"os"
+	"reflect"
+	"regexp"
+)
+
+// envPlaceholderRegexp matches an {env.NAME} placeholder and captures NAME.
+var envPlaceholderRegexp = regexp.MustCompile(`\{env\.([^{}\s]+)\}`)
+
+// expandEnv replaces {env.NAME} placeholders with the value of the environment variable NAME.
+func expandEnv(s string) string {
+	return envPlaceholderRegexp.ReplaceAllStringFunc(s, func(ph string) string {
+		return os.Getenv(envPlaceholderRegexp.FindStringSubmatch(ph)[1])
+	})
+}
+
+// expandEnvFields expands env placeholders in every exported string of the configuration
+// value v, descending into nested structs, pointers, slices and maps. Other placeholders
+// are left alone so they can still be replaced per request.
+func expandEnvFields(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			expandEnvFields(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				expandEnvFields(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			expandEnvFields(v.Index(i))
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			for _, key := range v.MapKeys() {
+				expandEnvFields(v.MapIndex(key))
+			}
+			return
+		}
+		for _, key := range v.MapKeys() {
+			v.SetMapIndex(key, reflect.ValueOf(expandEnv(v.MapIndex(key).String())).Convert(v.Type().Elem()))
+		}
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(expandEnv(v.String()))
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package wsheartbeat
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// clientCertHeaders maps the client certificate fields that can be forwarded to the
+// backend to their headers.
+var clientCertHeaders = map[string]string{
+	"cn":     "X-Client-Cert-CN",
+	"serial": "X-Client-Cert-Serial",
+	"pem":    "X-Client-Cert",
+}
+
+// defaultClientCertFields are the client certificate fields forwarded by default.
+var defaultClientCertFields = []string{"cn", "serial"}
+
+// setForwardedHeaders sets the X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host
+// and X-Real-IP headers of the backend handshake on h, the headers cloned from r. As
+// with Caddy's reverse_proxy, the values received from the client are only kept when
+// the immediate peer is a trusted proxy.
+func (m *WSHeartbeat) setForwardedHeaders(r *http.Request, h http.Header) {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// Don't let the backend trust headers that came from the client.
+		h.Del("X-Forwarded-For")
+		h.Del("X-Forwarded-Proto")
+		h.Del("X-Forwarded-Host")
+		h.Del("X-Real-IP")
+		return
+	}
+	// An IPv6 address may carry a zone.
+	peer, _, _ = strings.Cut(peer, "%")
+	trusted := m.trustedPeer(r)
+
+	// Append the peer to the proxies seen so far, folding multiple headers into one.
+	xff := peer
+	if prior := strings.Join(h.Values("X-Forwarded-For"), ", "); trusted && prior != "" {
+		xff = prior + ", " + peer
+	}
+	h.Set("X-Forwarded-For", xff)
+
+	proto := "https"
+	if r.TLS == nil {
+		proto = "http"
+	}
+	if values := h.Values("X-Forwarded-Proto"); trusted && len(values) > 0 && values[len(values)-1] != "" {
+		proto = values[len(values)-1]
+	}
+	h.Set("X-Forwarded-Proto", proto)
+
+	host := r.Host
+	if values := h.Values("X-Forwarded-Host"); trusted && len(values) > 0 && values[len(values)-1] != "" {
+		host = values[len(values)-1]
+	}
+	h.Set("X-Forwarded-Host", host)
+
+	// The real client IP is resolved by Caddy with the same trust.
+	h.Set("X-Real-IP", m.clientIP(r))
+}
+
+// validateClientCertFields checks the configured client certificate fields.
+func validateClientCertFields(fields []string) error {
+	for _, field := range fields {
+		if _, ok := clientCertHeaders[field]; !ok && !(field == "none" && len(fields) == 1) {
+			return fmt.Errorf("unknown client certificate field: %s", field)
+		}
+	}
+	return nil
+}
+
+// setClientCertHeaders sets the headers of the client certificate fields on h, the
+// headers cloned from r, when the client presented a certificate. Values sent by the
+// client are always removed, so they can't be spoofed.
+func (m *WSHeartbeat) setClientCertHeaders(r *http.Request, h http.Header) {
+	for _, name := range clientCertHeaders {
+		h.Del(name)
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return
+	}
+	fields := m.ClientCertFields
+	if len(fields) == 0 {
+		fields = defaultClientCertFields
+	}
+	cert := r.TLS.PeerCertificates[0]
+	for _, field := range fields {
+		switch field {
+		case "cn":
+			h.Set(clientCertHeaders[field], cert.Subject.CommonName)
+		case "serial":
+			h.Set(clientCertHeaders[field], cert.SerialNumber.String())
+		case "pem":
+			block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+			h.Set(clientCertHeaders[field], url.PathEscape(string(block)))
+		}
+	}
+}
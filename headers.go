@@ -0,0 +1,218 @@
+package wsheartbeat
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// HeaderRule changes one header of a handshake.
+type HeaderRule struct {
+	// Action is "set" (default), which replaces the header, "add", which appends a
+	// value, or "delete", which removes it.
+	Action string `json:"action,omitempty"`
+	// Name is the header name.
+	Name string `json:"name"`
+	// Value is the header value, with placeholders replaced per request. It is unused
+	// by "delete".
+	Value string `json:"value,omitempty"`
+}
+
+// RequiredHeader is a header that upgrades must carry.
+type RequiredHeader struct {
+	// Name is the header name.
+	Name string `json:"name"`
+	// Value, if set, is a regular expression one of the header's values must match.
+	// Use ^ and $ to match whole values.
+	Value string `json:"value,omitempty"`
+
+	valueRegexp *regexp.Regexp
+}
+
+// provisionRequiredHeaders compiles the value patterns of RequireHeaders.
+func (m *WSHeartbeat) provisionRequiredHeaders() error {
+	for i := range m.RequireHeaders {
+		required := &m.RequireHeaders[i]
+		if required.Name == "" {
+			return fmt.Errorf("require_header: header name must be specified")
+		}
+		required.valueRegexp = nil
+		if required.Value == "" {
+			continue
+		}
+		re, err := regexp.Compile(required.Value)
+		if err != nil {
+			return fmt.Errorf("require_header %s: invalid value pattern: %v", required.Name, err)
+		}
+		required.valueRegexp = re
+	}
+	return nil
+}
+
+// missingHeader returns the name of the first of RequireHeaders that the request
+// headers h lack, or don't carry a matching value of, or "" when they have all.
+func (m *WSHeartbeat) missingHeader(h http.Header) string {
+	for _, required := range m.RequireHeaders {
+		values := h.Values(required.Name)
+		if len(values) == 0 {
+			return required.Name
+		}
+		if required.valueRegexp != nil && !slices.ContainsFunc(values, required.valueRegexp.MatchString) {
+			return required.Name
+		}
+	}
+	return ""
+}
+
+// managedHeaders are the handshake headers set by the websocket dialer itself, which
+// rejects them in the request headers.
+var managedHeaders = []string{
+	"Connection",
+	"Host",
+	"Sec-Websocket-Extensions",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Protocol",
+	"Sec-Websocket-Version",
+	"Upgrade",
+}
+
+// validateHeaderRules checks the rules of the named option.
+func validateHeaderRules(option string, rules []HeaderRule) error {
+	for _, rule := range rules {
+		switch rule.Action {
+		case "", "set", "add", "delete":
+		default:
+			return fmt.Errorf("%s %s: unknown action %s", option, rule.Name, rule.Action)
+		}
+		if rule.Name == "" {
+			return fmt.Errorf("%s: header name must be specified", option)
+		}
+		for _, managed := range managedHeaders {
+			if http.CanonicalHeaderKey(rule.Name) == managed {
+				return fmt.Errorf("%s: the %s header can't be changed", option, rule.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// applyHeaderRules applies rules to h in order, replacing placeholders in the values
+// with repl.
+func applyHeaderRules(rules []HeaderRule, h http.Header, repl *caddy.Replacer) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case "delete":
+			h.Del(rule.Name)
+		case "add":
+			h.Add(rule.Name, repl.ReplaceAll(rule.Value, ""))
+		default:
+			h.Set(rule.Name, repl.ReplaceAll(rule.Value, ""))
+		}
+	}
+}
+
+// parseHeaderRule parses the arguments of a header rule like reverse_proxy's:
+// "+Name value" adds, "-Name" deletes, and "Name value" sets.
+func parseHeaderRule(d *caddyfile.Dispenser) (HeaderRule, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return HeaderRule{}, d.ArgErr()
+	}
+	var rule HeaderRule
+	switch name := args[0]; {
+	case strings.HasPrefix(name, "-"):
+		if len(args) != 1 {
+			return rule, d.ArgErr()
+		}
+		rule.Action, rule.Name = "delete", name[1:]
+	case strings.HasPrefix(name, "+"):
+		if len(args) != 2 {
+			return rule, d.ArgErr()
+		}
+		rule.Action, rule.Name, rule.Value = "add", name[1:], args[1]
+	default:
+		if len(args) != 2 {
+			return rule, d.ArgErr()
+		}
+		rule.Name, rule.Value = name, args[1]
+	}
+	if rule.Name == "" {
+		return rule, d.Errf("header name must be specified")
+	}
+	return rule, nil
+}
+
+// filterCookies applies the Cookies policy to h, the headers cloned from the client's
+// request. The allowed cookies are parsed and serialized again into a single header.
+func (m *WSHeartbeat) filterCookies(h http.Header) {
+	switch m.Cookies {
+	case "strip_all":
+		h.Del("Cookie")
+	case "allow":
+		cookies := (&http.Request{Header: h}).Cookies()
+		kept := make([]string, 0, len(cookies))
+		for _, cookie := range cookies {
+			if slices.Contains(m.AllowedCookies, cookie.Name) {
+				kept = append(kept, cookie.String())
+			}
+		}
+		h.Del("Cookie")
+		if len(kept) > 0 {
+			h.Set("Cookie", strings.Join(kept, "; "))
+		}
+	}
+}
+
+// hopByHopHeaders are the headers that only concern a single connection, and are
+// never copied from the backend's handshake response.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// copyableHeader reports whether the header name of resp may be copied to the client.
+// Hop-by-hop headers, those listed in resp's Connection header, and the websocket
+// headers, which the upgrader writes itself, never are.
+func copyableHeader(resp *http.Response, name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	if strings.HasPrefix(name, "Sec-Websocket-") || slices.Contains(hopByHopHeaders, name) {
+		return false
+	}
+	for _, value := range resp.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if http.CanonicalHeaderKey(strings.TrimSpace(token)) == name {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// copyHeadersDown returns the headers of the backend's handshake response resp
+// selected by names, or all of them with "*", to send to the client.
+func copyHeadersDown(names []string, resp *http.Response) http.Header {
+	if len(names) == 0 || resp == nil {
+		return nil
+	}
+	header := make(http.Header)
+	for name, values := range resp.Header {
+		if !copyableHeader(resp, name) {
+			continue
+		}
+		if slices.Contains(names, "*") || slices.ContainsFunc(names, func(n string) bool { return http.CanonicalHeaderKey(n) == name }) {
+			header[name] = append([]string(nil), values...)
+		}
+	}
+	return header
+}
@@ -0,0 +1,121 @@
+package wsheartbeat
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+// runHealthChecks actively checks every static upstream each health interval until
+// ctx is cancelled.
+func (m *WSHeartbeat) runHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(m.healthIntervalDuration)
+	defer ticker.Stop()
+	for {
+		m.checkUpstreams(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkUpstreams performs one round of health checks and marks each upstream up or down.
+func (m *WSHeartbeat) checkUpstreams(ctx context.Context) {
+	for _, route := range m.routes {
+		for _, up := range route.upstreams {
+			// Hosts with placeholders are only known per request.
+			if up.dynamic {
+				continue
+			}
+			err := m.checkUpstream(ctx, up)
+			if ctx.Err() != nil {
+				return
+			}
+			wasDown := up.unhealthy.Swap(err != nil)
+			switch {
+			case err != nil && !wasDown:
+				m.logger.Warn("backend failed health check, marking down",
+					zap.String("upstream", up.host),
+					zap.Error(err),
+				)
+				m.markedDown(up)
+			case err == nil && wasDown:
+				m.logger.Info("backend recovered, marking up", zap.String("upstream", up.host))
+			}
+		}
+	}
+}
+
+// checkUpstream completes a websocket handshake against the health path of up,
+// trying each of its resolved targets until one succeeds. The handshake is sent with
+// the Host header and SNI of proxied connections.
+func (m *WSHeartbeat) checkUpstream(ctx context.Context, up *upstream) error {
+	targets, err := m.resolve(ctx, up.target)
+	if err != nil {
+		return err
+	}
+	hostHeader := m.healthHostHeader()
+	for _, target := range targets {
+		header := http.Header{}
+		dialer := m.targetDialer(&m.dialer, target, hostHeader, header)
+		dialCtx, cancel := context.WithTimeout(ctx, m.dialTimeoutDuration)
+		var conn *websocket.Conn
+		conn, _, err = dialer.DialContext(dialCtx, target.url(m.healthURL), header)
+		cancel()
+		if err == nil {
+			// Close politely so the check doesn't look like an aborted session.
+			_ = conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(m.pingWriteTimeoutDuration))
+			_ = conn.Close()
+			return nil
+		}
+	}
+	return err
+}
+
+// healthHostHeader returns the Host header overridden for health checks, if any. As
+// no client request is behind a check, only global placeholders are replaced, and
+// preserve_host has no client Host to pass on, so the backend address is sent.
+func (m *WSHeartbeat) healthHostHeader() string {
+	if m.PreserveHost || m.HostHeader == "preserve" {
+		return ""
+	}
+	return caddy.NewReplacer().ReplaceAll(m.HostHeader, "")
+}
+
+// markedDown closes the connections proxied to up after the unhealthy grace period,
+// if close_on_unhealthy is enabled and up is still down by then.
+func (m *WSHeartbeat) markedDown(up *upstream) {
+	if !m.CloseOnUnhealthy {
+		return
+	}
+	time.AfterFunc(m.unhealthyGraceDuration, func() {
+		if !up.unhealthy.Load() && !up.breaker.open() {
+			return
+		}
+		m.mu.Lock()
+		var sessions []*session
+		for _, sess := range m.connections {
+			if sess.up == up {
+				sessions = append(sessions, sess)
+			}
+		}
+		m.mu.Unlock()
+		if len(sessions) == 0 {
+			return
+		}
+		m.logger.Warn("closing connections to backend marked down",
+			zap.String("upstream", up.host),
+			zap.Int("connections", len(sessions)),
+		)
+		for _, sess := range sessions {
+			sess.close(m.UnhealthyCloseCode, "upstream "+up.host+" marked down", "backend unavailable")
+		}
+	})
+}
@@ -0,0 +1,43 @@
+package wsheartbeat
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHealthCheckHostHeader(t *testing.T) {
+	// The backend reports the Host of each handshake.
+	hosts := make(chan string, 1)
+	backend := echoBackend(t, func(r *http.Request) { hosts <- r.Host })
+	tests := []struct {
+		name string
+		m    *WSHeartbeat
+		// want is the Host of the check; "" stands for the backend address.
+		want string
+	}{
+		{"default", &WSHeartbeat{}, ""},
+		{"host_header", &WSHeartbeat{HostHeader: "internal.example.com"}, "internal.example.com"},
+		{"preserve_host", &WSHeartbeat{PreserveHost: true}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.m.BackendHost = HostList{strings.TrimPrefix(backend.URL, "http://")}
+			tt.m.BackendPaths = []string{"/ws"}
+			provisionTest(t, tt.m)
+			tt.m.healthURL = &url.URL{Path: "/ws"}
+			if err := tt.m.checkUpstream(context.Background(), tt.m.routes[0].upstreams[0]); err != nil {
+				t.Fatalf("health check: %v", err)
+			}
+			want := tt.want
+			if want == "" {
+				want = strings.TrimPrefix(backend.URL, "http://")
+			}
+			if got := <-hosts; got != want {
+				t.Fatalf("health check sent Host %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,454 @@
+package wsheartbeat
+
+import (
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HeartbeatConfig configures the pings sent on one side of the proxied connections.
+// Unset values are inherited from the flat options of WSHeartbeat.
+type HeartbeatConfig struct {
+	// Interval between pings as a string (e.g., "15s").
+	Interval string `json:"interval,omitempty"`
+	// PongTimeout is how long to wait for a pong after a ping as a string (e.g., "10s").
+	PongTimeout string `json:"pong_timeout,omitempty"`
+	// MaxMissedPongs is the number of consecutive pings left unanswered before the
+	// connection is closed.
+	MaxMissedPongs int `json:"max_missed_pongs,omitempty"`
+	// InitialDelay is the wait before the first ping as a string (e.g., "30s").
+	InitialDelay string `json:"initial_delay,omitempty"`
+}
+
+// provision parses the settings of the side called name over inherited.
+func (c *HeartbeatConfig) provision(name string, inherited heartbeat) (heartbeat, error) {
+	hb := inherited
+	if c.Interval != "" {
+		dur, err := parseInterval(c.Interval)
+		if err != nil {
+			return hb, fmt.Errorf("invalid %s interval: %s", name, c.Interval)
+		}
+		hb.interval = dur
+	}
+	if c.PongTimeout != "" {
+		dur, err := time.ParseDuration(c.PongTimeout)
+		if err != nil || dur <= 0 {
+			return hb, fmt.Errorf("invalid %s pong timeout: %s", name, c.PongTimeout)
+		}
+		hb.pongTimeout = dur
+	}
+	if c.MaxMissedPongs < 0 {
+		return hb, fmt.Errorf("invalid %s max missed pongs: %d", name, c.MaxMissedPongs)
+	}
+	if c.MaxMissedPongs > 0 {
+		hb.maxMissedPongs = c.MaxMissedPongs
+	}
+	if c.InitialDelay != "" {
+		dur, err := time.ParseDuration(c.InitialDelay)
+		if err != nil || dur < 0 {
+			return hb, fmt.Errorf("invalid %s initial delay: %s", name, c.InitialDelay)
+		}
+		hb.initialDelay = dur
+	}
+	return hb, nil
+}
+
+// unmarshalCaddyfile parses the block of a client or backend heartbeat section.
+func (c *HeartbeatConfig) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Interval = d.Val()
+		case "pong_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.PongTimeout = d.Val()
+		case "max_missed_pongs":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			missed, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_missed_pongs: %v", err)
+			}
+			c.MaxMissedPongs = missed
+		case "initial_delay":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.InitialDelay = d.Val()
+		default:
+			return d.Errf("unknown heartbeat option: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// PathHeartbeat overrides the client heartbeat settings for the connections upgraded
+// on one path. Unset values are inherited from the handler's.
+type PathHeartbeat struct {
+	// Path is the request path the override applies to, matched exactly.
+	// Placeholders are replaced per request.
+	Path string `json:"path"`
+	HeartbeatConfig
+	// hb is the resolved heartbeat of the path.
+	hb heartbeat
+}
+
+// heartbeat holds the parsed ping settings of one side of the proxied connections.
+type heartbeat struct {
+	// interval is the time between two pings.
+	interval time.Duration
+	// pongTimeout is how long a ping may go unanswered, if set.
+	pongTimeout time.Duration
+	// maxMissedPongs is the number of consecutive missed pongs that close the connection.
+	maxMissedPongs int
+	// initialDelay is the wait before the first ping; zero waits one interval.
+	initialDelay time.Duration
+	// jitter is the largest random offset applied to the ping schedule.
+	jitter time.Duration
+	// jitterEach applies a new offset to every interval rather than only the first.
+	jitterEach bool
+	// minInterval and maxInterval bound the interval of each connection when it
+	// adapts to the pongs; a zero maxInterval keeps the interval fixed.
+	minInterval, maxInterval time.Duration
+}
+
+// jittered returns the interval randomly shifted by up to ±hb.jitter.
+func (hb heartbeat) jittered() time.Duration {
+	if hb.jitter <= 0 {
+		return hb.interval
+	}
+	return hb.interval - hb.jitter + rand.N(2*hb.jitter+1)
+}
+
+// readWindow returns how long the reads of a pinged peer may wait for its next pong:
+// the longest gap between two pings, which an adaptive interval may relax up to its
+// max, plus grace.
+func (hb heartbeat) readWindow(grace time.Duration) time.Duration {
+	return max(hb.interval, hb.maxInterval) + hb.jitter + grace
+}
+
+// firstPing returns the wait before the first ping. The jitter only ever extends an
+// initial delay, so no ping is sent before it.
+func (hb heartbeat) firstPing() time.Duration {
+	if hb.initialDelay == 0 {
+		return hb.jittered()
+	}
+	if hb.jitter <= 0 {
+		return hb.initialDelay
+	}
+	return hb.initialDelay + rand.N(hb.jitter+1)
+}
+
+// withJitter returns hb with the jitter given as a duration (e.g., "2s") or as a
+// percentage of the interval (e.g., "10%") applied.
+func (hb heartbeat) withJitter(jitter string, each bool) (heartbeat, error) {
+	if jitter == "" || hb.interval == 0 {
+		return hb, nil
+	}
+	if percent, ok := strings.CutSuffix(jitter, "%"); ok {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p < 0 || p >= 100 {
+			return hb, fmt.Errorf("invalid jitter: %s", jitter)
+		}
+		hb.jitter = time.Duration(float64(hb.interval) * p / 100)
+	} else {
+		dur, err := time.ParseDuration(jitter)
+		if err != nil || dur < 0 {
+			return hb, fmt.Errorf("invalid jitter: %s", jitter)
+		}
+		if dur >= hb.interval {
+			return hb, fmt.Errorf("jitter %s must be shorter than the interval %s", jitter, hb.interval)
+		}
+		hb.jitter = dur
+	}
+	hb.jitterEach = each
+	return hb, nil
+}
+
+// parseInterval parses a ping interval, where "off" or "0" disables the pings.
+func parseInterval(s string) (time.Duration, error) {
+	if s == "off" || s == "0" {
+		return 0, nil
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if dur <= 0 {
+		return 0, fmt.Errorf("interval must be positive or off")
+	}
+	return dur, nil
+}
+
+// validate checks that the settings of the side called name are consistent.
+func (hb heartbeat) validate(name string) error {
+	if hb.interval == 0 && (hb.pongTimeout > 0 || hb.maxMissedPongs > 0 || hb.initialDelay > 0) {
+		return fmt.Errorf("%s pings are off: pong timeouts and initial delay need an interval", name)
+	}
+	return nil
+}
+
+// pongWait returns how long a ping may go unanswered, or zero when pongs aren't
+// tracked. Without a pong timeout, a missed pong threshold waits one interval.
+func (hb heartbeat) pongWait() time.Duration {
+	if hb.pongTimeout == 0 && hb.maxMissedPongs > 0 {
+		return hb.interval
+	}
+	return hb.pongTimeout
+}
+
+// missedPongLimit returns the number of consecutive missed pongs that close the
+// connection (default 1).
+func (hb heartbeat) missedPongLimit() int64 {
+	return int64(max(hb.maxMissedPongs, 1))
+}
+
+// handlePing sends periodic ping messages to one leg of sess to keep it alive.
+// With a pong timeout, a peer that misses hb.maxMissedPongs pongs in a row is
+// disconnected together with the other leg. It returns as soon as sess is torn down.
+func (m *WSHeartbeat) handlePing(sess *session, l *leg, hb heartbeat) {
+	conn := l.conn
+	pongWait := hb.pongWait()
+	// With an adaptive interval, hb.interval follows the outcome of each ping.
+	var adapt *adaptiveState
+	if hb.maxInterval > 0 {
+		adapt = newAdaptiveState(hb)
+		hb.interval = adapt.current
+	}
+	// sent and answered describe the last ping, observed by the adaptive interval.
+	sent, answered := false, false
+	// Create a timer for the ping interval. It is re-armed after each ping, or after
+	// the last proxied message in idle_only mode. The first wait is the initial delay,
+	// if any, and is jittered so that connections opened together don't get pinged
+	// on the same tick.
+	first := hb.firstPing()
+	pingTimer := m.newTimer(first)
+	defer pingTimer.Stop()
+
+	// With a read deadline grace, a peer whose pong doesn't arrive by the next ping
+	// plus the grace gets its reads timed out, tearing down the pair. Each pong pushes
+	// the deadline out again.
+	if l.readWindow > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(first + m.readDeadlineGraceDuration))
+	}
+
+	// pongTimer runs from the first unanswered ping until a pong arrives.
+	var pongTimer timer
+	var pongDeadline <-chan time.Time
+	defer func() {
+		if pongTimer != nil {
+			pongTimer.Stop()
+		}
+	}()
+
+	// Send a ping on each tick, until the connection is torn down.
+	for {
+		select {
+		case <-sess.done:
+			return
+		case <-pingTimer.C():
+			// Wait out the rest of the interval if the connection was active meanwhile.
+			if m.IdleOnly {
+				if idle := sess.idle(); idle < hb.interval {
+					pingTimer.Reset(hb.interval - idle)
+					continue
+				}
+			}
+			// Adapt the interval to whether the last ping got a timely pong.
+			if adapt != nil && sent {
+				slow := answered && l.rtt.Load() > 2*l.avgRTT.Load()
+				if next := adapt.observe(answered, slow); next != hb.interval {
+					sess.logger.Debug("Adapted ping interval",
+						zap.String("to", l.name),
+						zap.Duration("interval", next),
+					)
+					hb.interval = next
+				}
+			}
+			if hb.jitterEach {
+				pingTimer.Reset(hb.jittered())
+			} else {
+				pingTimer.Reset(hb.interval)
+			}
+			// Write a ping message, stamped for RTT measurement, or an unsolicited pong,
+			// with a deadline. With suppressed pings, the protocol's own heartbeat is
+			// awaited instead.
+			if !m.SuppressPings {
+				err := l.writeControl(m.keepaliveFrameType, l.pingPayload(m.PingPayload, sess.repl), time.Now().Add(m.pingWriteTimeoutDuration))
+				if errors.Is(err, errSessionDone) {
+					return
+				} else if err != nil {
+					sess.logger.Warn("Failed to send ping, closing connection", zap.String("to", l.name), zap.Error(err))
+					return
+				} else {
+					l.pings.Add(1)
+					sess.logger.Debug("Sent ping", zap.String("to", l.name))
+				}
+			}
+			sent, answered = true, false
+			// Start waiting for the pong, unless an earlier ping is still unanswered.
+			if pongWait > 0 && pongTimer == nil {
+				pongTimer = m.newTimer(pongWait)
+				pongDeadline = pongTimer.C()
+			}
+		case <-l.alive:
+			// The peer is alive; stop waiting and forget earlier misses.
+			answered = true
+			l.missedPongs.Store(0)
+			if pongTimer != nil {
+				pongTimer.Stop()
+				pongTimer, pongDeadline = nil, nil
+			}
+		case <-pongDeadline:
+			// Count the miss; the next ping starts a new wait unless this was the last allowed.
+			pongTimer, pongDeadline = nil, nil
+			missed := l.missedPongs.Add(1)
+			if missed < hb.missedPongLimit() {
+				sess.logger.Debug("no pong received within timeout",
+					zap.String("from", l.name),
+					zap.String("remote_addr", conn.RemoteAddr().String()),
+					zap.Int64("missed_pongs", missed),
+				)
+				continue
+			}
+			sess.logger.Warn("no pong received within timeout, closing connection",
+				zap.String("from", l.name),
+				zap.String("remote_addr", conn.RemoteAddr().String()),
+				zap.Duration("pong_timeout", pongWait),
+				zap.Int64("missed_pongs", missed),
+			)
+			m.closeForHeartbeat(sess, fmt.Sprintf("%s closed after %d missed pongs", l.name, missed))
+			return
+		}
+	}
+}
+
+// handlePongs sets the pong handler of one leg of sess. Pongs echoing our pings
+// record the round-trip time; others are relayed to l.pongsTo, if set, unless they
+// come after the relay timeout. Any pong
+// proves the peer alive. The handler runs on the proxy read loop, so it must be set
+// before reading starts, and it only signals the ping goroutine and never blocks.
+func (m *WSHeartbeat) handlePongs(sess *session, l *leg) {
+	l.conn.SetPongHandler(func(appData string) error {
+		l.lastPong.Store(int64(time.Since(monoEpoch)))
+		if rtt, ok := l.recordPong(appData); ok {
+			sess.logger.Debug("Received pong",
+				zap.String("from", l.name),
+				zap.Duration("rtt", rtt),
+				zap.Duration("avg_rtt", time.Duration(l.avgRTT.Load())),
+			)
+		} else if to := l.pongsTo; to != nil {
+			if l.takeRelayed(appData) {
+				err := to.writeControl(websocket.PongMessage, []byte(appData), time.Now().Add(sess.writeTimeout))
+				if err != nil {
+					sess.logger.Debug("Failed to relay pong", zap.String("to", to.name), zap.Error(err))
+				}
+			} else {
+				sess.logger.Debug("Dropped late pong to a relayed ping", zap.String("from", l.name))
+			}
+		} else {
+			l.unexpectedPongs.Add(1)
+			sess.logger.Debug("Received pong with unexpected payload",
+				zap.String("from", l.name),
+				zap.Int("payload_size", len(appData)),
+			)
+		}
+		l.extendReadDeadline()
+		l.markAlive()
+		return nil
+	})
+}
+
+// handlePings sets the ping handler of one leg of sess. A ping proves the peer alive
+// like a pong, resetting its missed pongs and read deadline. It is relayed to
+// l.pingsTo, if set, or else answered with a pong. The frames are queued to the
+// writer of the leg, ahead of its data messages, and bounded by the control frame
+// timeout.
+func (m *WSHeartbeat) handlePings(sess *session, l *leg) {
+	l.conn.SetPingHandler(func(appData string) error {
+		l.peerPings.Add(1)
+		l.extendReadDeadline()
+		l.markAlive()
+		if to := l.pingsTo; to != nil {
+			to.noteRelayed(appData)
+			err := to.writeControl(websocket.PingMessage, []byte(appData), time.Now().Add(sess.writeTimeout))
+			if err != nil {
+				sess.logger.Debug("Failed to relay ping", zap.String("to", to.name), zap.Error(err))
+			}
+			return nil
+		}
+		// Answer like the default handler, which ignores a closing or slow peer, or a
+		// torn down session.
+		err := l.writeControl(websocket.PongMessage, []byte(appData), time.Now().Add(sess.writeTimeout))
+		var netErr net.Error
+		if errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, errSessionDone) || errors.As(err, &netErr) && netErr.Timeout() {
+			return nil
+		}
+		return err
+	})
+}
+
+// closeForHeartbeat closes both connections of sess after a failed heartbeat, with
+// the heartbeat close code and reason. The reason defaults to the logged one.
+func (m *WSHeartbeat) closeForHeartbeat(sess *session, reason string) {
+	text := reason
+	if m.HeartbeatCloseReason != "" {
+		text = m.HeartbeatCloseReason
+	}
+	sess.close(m.HeartbeatCloseCode, reason, text)
+}
+
+// validCloseCode reports whether code may be sent in a close frame: a defined status
+// code, or one in the range reserved for libraries and applications.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	default:
+		return code >= 3000 && code <= 4999
+	}
+}
+
+// truncateCloseReason shortens reason to fit a close frame next to its status code,
+// without splitting a UTF-8 sequence.
+func truncateCloseReason(reason string) string {
+	limit := maxControlPayload - 2
+	if len(reason) <= limit {
+		return reason
+	}
+	for limit > 0 && !utf8.RuneStart(reason[limit]) {
+		limit--
+	}
+	return reason[:limit]
+}
+
+// normalClose reports whether err is a close frame of a peer ending the connection
+// normally, going away, or without a status code.
+func normalClose(err error) bool {
+	return websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived)
+}
+
+// closeWith sends a close frame with code and reason on each connection, within
+// writeTimeout, then closes it. Connections proxied by a session are closed through
+// their writers instead. Reasons too long for a close frame are truncated.
+func closeWith(code int, reason string, writeTimeout time.Duration, conns ...*websocket.Conn) {
+	msg := websocket.FormatCloseMessage(code, truncateCloseReason(reason))
+	for _, conn := range conns {
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeTimeout))
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,116 @@
+package wsheartbeat
+
+import (
+	"github.com/gorilla/websocket"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdleOnlySkipsPingsWhileChatty(t *testing.T) {
+	proxy := serveProxy(t, &WSHeartbeat{Interval: "200ms", IdleOnly: true}, echoBackend(t, nil))
+	conn, _, err := dialProxy(t, proxy, "/ws", nil)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	var pings atomic.Int64
+	conn.SetPingHandler(func(string) error {
+		pings.Add(1)
+		return nil
+	})
+
+	// Exchange a message every 20ms for several intervals.
+	for range 40 {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("chat")); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got := pings.Load(); got != 0 {
+		t.Fatalf("chatty connection got %d pings, want none", got)
+	}
+
+	// Once quiet for an interval, it is pinged again.
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	waitFor(t, "a ping on the idle connection", func() bool { return pings.Load() > 0 })
+}
+
+func TestReadDeadlineWithoutPongs(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *WSHeartbeat
+		// send is the message the client sends every 20ms, if any.
+		send string
+	}{
+		{"idle_only", &WSHeartbeat{Interval: "200ms", IdleOnly: true, ReadDeadlineGrace: "100ms"}, "chat"},
+		{"engineio suppress_pings", &WSHeartbeat{Interval: "100ms", Protocol: "engineio", SuppressPings: true, ReadDeadlineGrace: "50ms"}, "3"},
+		{"sockjs suppress_pings", &WSHeartbeat{Interval: "100ms", Protocol: "sockjs", SuppressPings: true, ReadDeadlineGrace: "50ms"}, `["chat"]`},
+		// Only the pongs keep the connection open, with pings up to 40ms late.
+		{"jitter over the grace", &WSHeartbeat{Interval: "100ms", Jitter: "40ms", JitterPerInterval: true, ReadDeadlineGrace: "10ms"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := serveProxy(t, tt.m, echoBackend(t, nil))
+			conn, _, err := dialProxy(t, proxy, "/ws", nil)
+			if err != nil {
+				t.Fatalf("dialing: %v", err)
+			}
+			defer conn.Close()
+			// Read on, answering pings, until the connection is closed.
+			echoed := make(chan string, 256)
+			go func() {
+				defer close(echoed)
+				for {
+					_, msg, err := conn.ReadMessage()
+					if err != nil {
+						return
+					}
+					select {
+					case echoed <- string(msg):
+					default:
+					}
+				}
+			}()
+
+			// Several read windows go by.
+			for range 50 {
+				if tt.send != "" {
+					if err := conn.WriteMessage(websocket.TextMessage, []byte(tt.send)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+
+			// The connection still proxies messages.
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("last")); err != nil {
+				t.Fatal(err)
+			}
+			timeout := time.After(5 * time.Second)
+			for {
+				select {
+				case msg, ok := <-echoed:
+					if !ok {
+						t.Fatal("connection closed")
+					}
+					if msg == "last" {
+						return
+					}
+				case <-timeout:
+					t.Fatal("no echo of the last message")
+				}
+			}
+		})
+	}
+}
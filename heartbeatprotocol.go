@@ -0,0 +1,69 @@
+package wsheartbeat
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/gorilla/websocket"
+)
+
+func init() {
+	// Register the built-in heartbeat protocol.
+	caddy.RegisterModule(PingProtocol{})
+}
+
+// HeartbeatProtocol is an in-band heartbeat defined by a guest module in the
+// http.handlers.ws_heartbeat.protocols namespace. Each interval, the probe is sent to
+// the client instead of a ping, and a peer that doesn't reply within the pong
+// timeout is disconnected.
+type HeartbeatProtocol interface {
+	// MakeProbe returns the message sent to the peer each interval. ctx is the
+	// context of the upgrade request, which carries its replacer.
+	MakeProbe(ctx context.Context) (msgType int, payload []byte)
+	// IsReply reports whether a data message read from the peer answers a probe.
+	// Replies are consumed instead of proxied.
+	IsReply(msgType int, payload []byte) bool
+}
+
+// PingProtocol is the built-in heartbeat: protocol pings answered by pongs, with the
+// payload, round-trip times and pong timeouts configured on the handler. It is used
+// when no other protocol module is configured.
+type PingProtocol struct{}
+
+// CaddyModule returns the Caddy module information.
+func (PingProtocol) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.ws_heartbeat.protocols.ping",
+		New: func() caddy.Module { return new(PingProtocol) },
+	}
+}
+
+// MakeProbe returns an empty ping. The handler sends its own pings instead, stamped
+// for round-trip time measurement.
+func (PingProtocol) MakeProbe(context.Context) (int, []byte) {
+	return websocket.PingMessage, nil
+}
+
+// IsReply reports false, as pongs are control frames handled by the pong handler
+// rather than data messages.
+func (PingProtocol) IsReply(int, []byte) bool {
+	return false
+}
+
+// UnmarshalCaddyfile sets up the protocol from Caddyfile tokens. It takes no options.
+func (p *PingProtocol) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume the module name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	if d.NextBlock(0) {
+		return d.Errf("unknown ping protocol option: %s", d.Val())
+	}
+	return nil
+}
+
+// Ensure PingProtocol implements the required interfaces.
+var (
+	_ HeartbeatProtocol     = (*PingProtocol)(nil)
+	_ caddyfile.Unmarshaler = (*PingProtocol)(nil)
+)
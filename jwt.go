@@ -0,0 +1,335 @@
+package wsheartbeat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksRefresh is how long fetched JSON web keys are used before they are fetched
+	// again.
+	jwksRefresh = 5 * time.Minute
+	// jwksMinRefresh is the shortest time between two fetches triggered by tokens
+	// signed with unknown keys.
+	jwksMinRefresh = time.Minute
+	// maxJWKSSize is the largest JSON web key set read from JWKSURL.
+	maxJWKSSize = 1 << 20
+)
+
+// hmacAlgorithms are the signature algorithms accepted with a Secret, and only with
+// one, so that a public key can't be used as an HMAC secret.
+var hmacAlgorithms = []string{string(jose.HS256), string(jose.HS384), string(jose.HS512)}
+
+// JWTAuth requires a valid JSON web token on upgrades before the backend is dialed.
+// Its claims are set as {ws.jwt.<claim>} placeholders, which header_up can forward.
+type JWTAuth struct {
+	// Secret is the key of HMAC-signed tokens (HS256, HS384 and HS512).
+	Secret string `json:"secret,omitempty"`
+	// JWKSURL is the URL of the JSON web key set verifying tokens signed with public
+	// keys. It is fetched on first use, and again every 5 minutes or when a token
+	// names an unknown key.
+	JWKSURL string `json:"jwks_url,omitempty"`
+	// Issuer, if set, must match the "iss" claim.
+	Issuer string `json:"issuer,omitempty"`
+	// Audience, if set, must be one of the "aud" claim.
+	Audience string `json:"audience,omitempty"`
+	// TokenSource is where the token is read: "header" (default), the Authorization
+	// header as a bearer token, "query", a query parameter, or "cookie".
+	TokenSource string `json:"token_source,omitempty"`
+	// TokenName is the name of the query parameter (default token) or of the cookie
+	// carrying the token.
+	TokenName string `json:"token_name,omitempty"`
+	// AllowNoExpiry accepts tokens without an "exp" claim, which never expire. They
+	// are rejected by default.
+	AllowNoExpiry bool `json:"allow_no_expiry,omitempty"`
+
+	client *http.Client
+	// mu protects keys, fetched, fetching and fetchErr. It is never held while the
+	// keys are fetched.
+	mu      sync.Mutex
+	keys    *jose.JSONWebKeySet
+	fetched time.Time
+	// fetching is closed when the fetch of the keys in flight, if any, completes.
+	fetching chan struct{}
+	// fetchErr is the error of the last fetch.
+	fetchErr error
+}
+
+// provision checks the configuration of the token validation.
+func (a *JWTAuth) provision() error {
+	switch {
+	case a.Secret != "" && a.JWKSURL != "":
+		return fmt.Errorf("jwt: secret and jwks_url are exclusive")
+	case a.Secret == "" && a.JWKSURL == "":
+		return fmt.Errorf("jwt: secret or jwks_url must be specified")
+	}
+	if a.JWKSURL != "" {
+		u, err := url.Parse(a.JWKSURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("jwt: invalid jwks_url: %s", a.JWKSURL)
+		}
+	}
+	switch a.TokenSource {
+	case "", "header":
+	case "query":
+		if a.TokenName == "" {
+			a.TokenName = "token"
+		}
+	case "cookie":
+		if a.TokenName == "" {
+			return fmt.Errorf("jwt: the token cookie name must be specified")
+		}
+	default:
+		return fmt.Errorf("jwt token_source must be header, query or cookie, got %s", a.TokenSource)
+	}
+	a.client = &http.Client{Timeout: 10 * time.Second}
+	return nil
+}
+
+// token returns the raw token of the upgrade r, or "" when it carries none.
+func (a *JWTAuth) token(r *http.Request) string {
+	switch a.TokenSource {
+	case "query":
+		return r.URL.Query().Get(a.TokenName)
+	case "cookie":
+		if cookie, err := r.Cookie(a.TokenName); err == nil {
+			return cookie.Value
+		}
+		return ""
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// verify validates the token of the upgrade r and sets its claims on repl.
+func (a *JWTAuth) verify(r *http.Request, repl *caddy.Replacer) error {
+	raw := a.token(r)
+	if raw == "" {
+		return fmt.Errorf("missing token")
+	}
+	tok, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return fmt.Errorf("parsing token: %v", err)
+	}
+	if len(tok.Headers) != 1 {
+		return fmt.Errorf("token must have a single signature")
+	}
+	header := tok.Headers[0]
+	hmac := false
+	for _, alg := range hmacAlgorithms {
+		hmac = hmac || header.Algorithm == alg
+	}
+	var key any
+	if a.Secret != "" {
+		if !hmac {
+			return fmt.Errorf("unexpected token algorithm %s", header.Algorithm)
+		}
+		key = []byte(a.Secret)
+	} else {
+		if hmac || header.Algorithm == "none" {
+			return fmt.Errorf("unexpected token algorithm %s", header.Algorithm)
+		}
+		if key, err = a.publicKey(r.Context(), header.KeyID); err != nil {
+			return err
+		}
+	}
+
+	var claims jwt.Claims
+	var all map[string]any
+	if err := tok.Claims(key, &claims, &all); err != nil {
+		return fmt.Errorf("verifying token: %v", err)
+	}
+	expected := jwt.Expected{Issuer: a.Issuer}
+	if a.Audience != "" {
+		expected.Audience = jwt.Audience{a.Audience}
+	}
+	if err := claims.Validate(expected); err != nil {
+		return fmt.Errorf("validating token claims: %v", err)
+	}
+	if claims.Expiry == nil && !a.AllowNoExpiry {
+		return fmt.Errorf("token has no expiry")
+	}
+	for name, value := range all {
+		repl.Set("ws.jwt."+name, claimString(value))
+	}
+	return nil
+}
+
+// publicKey returns the key of JWKSURL with the ID kid, or the only one when a token
+// names none. The key set is fetched again when it is stale, or when it doesn't have
+// kid and wasn't fetched in the last minute.
+func (a *JWTAuth) publicKey(ctx context.Context, kid string) (any, error) {
+	a.mu.Lock()
+	keys, fetched := a.keys, a.fetched
+	a.mu.Unlock()
+	if keys == nil || time.Since(fetched) > jwksRefresh {
+		// Stale keys are still used when they can't be fetched again.
+		var err error
+		if keys, fetched, err = a.refreshKeys(ctx); keys == nil {
+			return nil, err
+		}
+	}
+	key, ok := findKey(keys, kid)
+	if !ok && time.Since(fetched) > jwksMinRefresh {
+		var err error
+		if keys, _, err = a.refreshKeys(ctx); err != nil {
+			return nil, err
+		}
+		key, ok = findKey(keys, kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("no key for the token key ID %q", kid)
+	}
+	return key, nil
+}
+
+// refreshKeys fetches the key set again, or waits for the fetch already in flight, so
+// that concurrent upgrades share a single fetch. It returns the keys fetched last,
+// when they were, and the error of the fetch. Giving up on ctx doesn't cancel the
+// fetch, whose result is cached for the next upgrades.
+func (a *JWTAuth) refreshKeys(ctx context.Context) (*jose.JSONWebKeySet, time.Time, error) {
+	a.mu.Lock()
+	if a.fetching == nil {
+		a.fetching = make(chan struct{})
+		go a.fetchKeys(a.fetching)
+	}
+	done := a.fetching
+	a.mu.Unlock()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, time.Time{}, ctx.Err()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.keys, a.fetched, a.fetchErr
+}
+
+// fetchKeys fetches the key set of JWKSURL into the cache, then closes done. The
+// previous keys are kept when it fails.
+func (a *JWTAuth) fetchKeys(done chan struct{}) {
+	keys, err := a.getKeys()
+	a.mu.Lock()
+	if err == nil {
+		a.keys, a.fetched = keys, time.Now()
+	}
+	a.fetchErr, a.fetching = err, nil
+	a.mu.Unlock()
+	close(done)
+}
+
+// getKeys gets the key set of JWKSURL, within the timeout of the client.
+func (a *JWTAuth) getKeys() (*jose.JSONWebKeySet, error) {
+	resp, err := a.client.Get(a.JWKSURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching JSON web keys: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JSON web keys: status %d", resp.StatusCode)
+	}
+	var keys jose.JSONWebKeySet
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("decoding JSON web keys: %v", err)
+	}
+	return &keys, nil
+}
+
+// findKey looks kid up in keys, which may be nil.
+func findKey(keys *jose.JSONWebKeySet, kid string) (any, bool) {
+	if keys == nil {
+		return nil, false
+	}
+	if kid == "" {
+		if len(keys.Keys) == 1 {
+			return keys.Keys[0].Key, true
+		}
+		return nil, false
+	}
+	if found := keys.Key(kid); len(found) > 0 {
+		return found[0].Key, true
+	}
+	return nil, false
+}
+
+// claimString formats the claim value v for a placeholder: strings as they are,
+// numbers without exponent, and other values as JSON.
+func claimString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// unmarshalCaddyfile parses the block of jwt.
+func (a *JWTAuth) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "secret", "jwks_url", "issuer", "audience":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch option {
+			case "secret":
+				a.Secret = d.Val()
+			case "jwks_url":
+				a.JWKSURL = d.Val()
+			case "issuer":
+				a.Issuer = d.Val()
+			case "audience":
+				a.Audience = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "token_source":
+			// Parse the source of the token, with the optional query parameter or
+			// cookie name.
+			args := d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			a.TokenSource = args[0]
+			if len(args) == 2 {
+				a.TokenName = args[1]
+			}
+		case "allow_no_expiry":
+			// Parse the optional on/off flag; no argument means on.
+			a.AllowNoExpiry = true
+			if d.NextArg() {
+				switch d.Val() {
+				case "on":
+				case "off":
+					a.AllowNoExpiry = false
+				default:
+					return d.Errf("allow_no_expiry must be on or off, got %s", d.Val())
+				}
+			}
+		default:
+			return d.Errf("unknown jwt option: %s", option)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package wsheartbeat
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// signToken returns a token with claims signed by key, under the key ID kid.
+func signToken(t *testing.T, alg jose.SignatureAlgorithm, key any, kid string, claims any) string {
+	t.Helper()
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	if kid != "" {
+		opts = opts.WithHeader("kid", kid)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// bearerRequest returns an upgrade carrying token as a bearer token.
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestJWTRequiresExpiry(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	expiring := signToken(t, jose.HS256, secret, "", jwt.Claims{Subject: "u1", Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))})
+	expired := signToken(t, jose.HS256, secret, "", jwt.Claims{Subject: "u1", Expiry: jwt.NewNumericDate(time.Now().Add(-time.Hour))})
+	forever := signToken(t, jose.HS256, secret, "", jwt.Claims{Subject: "u1"})
+
+	tests := []struct {
+		name          string
+		token         string
+		allowNoExpiry bool
+		ok            bool
+	}{
+		{"expiring", expiring, false, true},
+		{"expired", expired, false, false},
+		{"no expiry", forever, false, false},
+		{"no expiry allowed", forever, true, true},
+		{"expired with no expiry allowed", expired, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &JWTAuth{Secret: string(secret), AllowNoExpiry: tt.allowNoExpiry}
+			if err := a.provision(); err != nil {
+				t.Fatal(err)
+			}
+			err := a.verify(bearerRequest(tt.token), caddy.NewReplacer())
+			if (err == nil) != tt.ok {
+				t.Fatalf("verify = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestJWKSFetchDoesNotBlockCachedKeys(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keySet := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "k1", Algorithm: string(jose.ES256), Use: "sig"}}}
+
+	// The key set is served at once the first time, and held afterwards until the
+	// test releases it.
+	var fetches atomic.Int32
+	fetching := make(chan struct{}, 16)
+	release := make(chan struct{})
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			fetching <- struct{}{}
+			<-release
+		}
+		_ = json.NewEncoder(w).Encode(keySet)
+	}))
+	t.Cleanup(jwks.Close)
+	t.Cleanup(func() { close(release) })
+
+	a := &JWTAuth{JWKSURL: jwks.URL}
+	if err := a.provision(); err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.Claims{Subject: "u1", Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+	known := signToken(t, jose.ES256, key, "k1", claims)
+	unknown := signToken(t, jose.ES256, key, "k2", claims)
+	if err := a.verify(bearerRequest(known), caddy.NewReplacer()); err != nil {
+		t.Fatalf("verifying with the fetched key: %v", err)
+	}
+
+	// Tokens naming an unknown key trigger a single slow fetch, once the keys are old
+	// enough to be fetched again.
+	a.mu.Lock()
+	a.fetched = time.Now().Add(-2 * jwksMinRefresh)
+	a.mu.Unlock()
+	unknownDone := make(chan error, 2)
+	for range 2 {
+		go func() { unknownDone <- a.verify(bearerRequest(unknown), caddy.NewReplacer()) }()
+	}
+	<-fetching
+
+	// Meanwhile, tokens signed with a cached key verify at once.
+	verified := make(chan error, 1)
+	go func() { verified <- a.verify(bearerRequest(known), caddy.NewReplacer()) }()
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Fatalf("verifying with a cached key: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("verifying with a cached key waited for the slow fetch")
+	}
+
+	// An upgrade waiting for the fetch can give up on its own.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := a.refreshKeys(ctx); err != context.Canceled {
+		t.Fatalf("refreshKeys with a cancelled context = %v, want context.Canceled", err)
+	}
+
+	release <- struct{}{}
+	for range 2 {
+		if err := <-unknownDone; err == nil {
+			t.Fatal("verified a token signed with an unknown key")
+		}
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Fatalf("fetched the keys %d times, want 2", got)
+	}
+}
@@ -0,0 +1,43 @@
+package wsheartbeat
+
+// connLimits counts the proxied connections of a handler, in total and per client IP,
+// to enforce MaxConnections and MaxConnectionsPerIP.
+type connLimits struct {
+	// total is the number of connections being set up or proxied.
+	total int
+	// perIP is the number of those connections by client IP. IPs without any are
+	// removed, so the map doesn't grow with every client ever seen.
+	perIP map[string]int
+}
+
+// acquireConn counts a new connection from the client ip, unless it would exceed
+// MaxConnections or MaxConnectionsPerIP. It returns the counts before the new
+// connection, for logging. Every acquired connection must be released with
+// releaseConn.
+func (m *WSHeartbeat) acquireConn(ip string) (ok bool, total, perIP int) {
+	m.limitsMu.Lock()
+	defer m.limitsMu.Unlock()
+	total, perIP = m.limits.total, m.limits.perIP[ip]
+	if m.MaxConnections > 0 && total >= m.MaxConnections {
+		return false, total, perIP
+	}
+	if m.MaxConnectionsPerIP > 0 && perIP >= m.MaxConnectionsPerIP {
+		return false, total, perIP
+	}
+	if m.limits.perIP == nil {
+		m.limits.perIP = make(map[string]int)
+	}
+	m.limits.total++
+	m.limits.perIP[ip]++
+	return true, total, perIP
+}
+
+// releaseConn uncounts a connection from the client ip acquired by acquireConn.
+func (m *WSHeartbeat) releaseConn(ip string) {
+	m.limitsMu.Lock()
+	defer m.limitsMu.Unlock()
+	m.limits.total--
+	if m.limits.perIP[ip]--; m.limits.perIP[ip] <= 0 {
+		delete(m.limits.perIP, ip)
+	}
+}
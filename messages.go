@@ -0,0 +1,71 @@
+package wsheartbeat
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/gorilla/websocket"
+	"io"
+)
+
+// defaultMaxMessageSize is the largest message read from either side by default.
+const defaultMaxMessageSize = 32 << 20
+
+// messageTooBigError is returned by readMessage for a message over the read limit.
+type messageTooBigError struct {
+	// leg is the name of the side that sent the message.
+	leg string
+	// limit is the read limit of the side.
+	limit int64
+	// read is how much of the message was read before giving up, past the limit.
+	read int64
+}
+
+func (e *messageTooBigError) Error() string {
+	return fmt.Sprintf("message from %s exceeds %d bytes", e.leg, e.limit)
+}
+
+// parseMessageSize parses a message size limit, in bytes or with a unit (e.g.,
+// "32MiB"), with "" meaning fallback and 0 no limit.
+func parseMessageSize(option, size string, fallback int64) (int64, error) {
+	if size == "" {
+		return fallback, nil
+	}
+	n, err := humanize.ParseBytes(size)
+	if err != nil || n > 1<<62 {
+		return 0, fmt.Errorf("invalid %s: %s", option, size)
+	}
+	return int64(n), nil
+}
+
+// readMessage reads the next message from the leg, like the connection's
+// ReadMessage. A message over the leg's read limit fails with a messageTooBigError
+// as soon as the limit is passed, without buffering the rest.
+func (l *leg) readMessage() (int, []byte, error) {
+	if l.readLimit <= 0 {
+		return l.conn.ReadMessage()
+	}
+	msgType, r, err := l.conn.NextReader()
+	if err != nil {
+		return msgType, nil, err
+	}
+	msg, err := io.ReadAll(io.LimitReader(r, l.readLimit+1))
+	if err != nil {
+		return msgType, nil, err
+	}
+	if int64(len(msg)) > l.readLimit {
+		return msgType, nil, &messageTooBigError{leg: l.name, limit: l.readLimit, read: int64(len(msg))}
+	}
+	return msgType, msg, nil
+}
+
+// messageTypeName returns the name of the data message type msgType, for logs and
+// close reasons.
+func messageTypeName(msgType int) string {
+	switch msgType {
+	case websocket.TextMessage:
+		return "text"
+	case websocket.BinaryMessage:
+		return "binary"
+	}
+	return fmt.Sprintf("type %d", msgType)
+}
@@ -0,0 +1,82 @@
+package wsheartbeat
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// originRule is one allowed origin of Origins.
+type originRule struct {
+	// scheme is the required scheme, or "" for any.
+	scheme string
+	// host is the required host without its port, or a "*." wildcard pattern.
+	host string
+	// port is the required port, or "" for any.
+	port string
+}
+
+// provisionOrigins parses Origins. Without any, only same-origin upgrades are
+// allowed, as by gorilla/websocket's default check.
+func (m *WSHeartbeat) provisionOrigins() error {
+	m.originRules = nil
+	m.anyOrigin, m.sameOrigin = false, len(m.Origins) == 0
+	for _, origin := range m.Origins {
+		switch origin {
+		case "any", "*":
+			m.anyOrigin = true
+			continue
+		case "same_origin":
+			m.sameOrigin = true
+			continue
+		}
+		var rule originRule
+		hostport := origin
+		if scheme, rest, ok := strings.Cut(origin, "://"); ok {
+			rule.scheme, hostport = strings.ToLower(scheme), rest
+		}
+		rule.host = hostport
+		if i := strings.LastIndex(hostport, ":"); i >= 0 && !strings.Contains(hostport[i:], "]") {
+			rule.host, rule.port = hostport[:i], hostport[i+1:]
+		}
+		rule.host = strings.ToLower(strings.Trim(rule.host, "[]"))
+		if !validHostPattern(rule.host) && !strings.Contains(rule.host, ":") {
+			return fmt.Errorf("invalid origin: %s", origin)
+		}
+		m.originRules = append(m.originRules, rule)
+	}
+	return nil
+}
+
+// allowedOrigin reports whether the Origin of the upgrade r is allowed. Requests
+// without an Origin, sent by non-browser clients, are unless RequireOrigin.
+func (m *WSHeartbeat) allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return !m.RequireOrigin
+	}
+	if m.anyOrigin {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if m.sameOrigin && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	host := normalizeHost(u.Host)
+	for _, rule := range m.originRules {
+		if rule.scheme != "" && rule.scheme != strings.ToLower(u.Scheme) {
+			continue
+		}
+		if rule.port != "" && rule.port != u.Port() {
+			continue
+		}
+		if rule.host == host || matchWildcardHost(rule.host, host) {
+			return true
+		}
+	}
+	return false
+}
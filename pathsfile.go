@@ -0,0 +1,122 @@
+package wsheartbeat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// pathList is a set of backend paths loaded from BackendPathsFile.
+type pathList struct {
+	// paths are the backend paths, in file order.
+	paths []string
+	// regexps holds the compiled regular expression of each path starting with "~",
+	// and nil for the others.
+	regexps []*regexp.Regexp
+}
+
+// loadPathsFile reads BackendPathsFile into the first route. Malformed lines are
+// logged and skipped. It returns the raw contents, so that reloads can tell whether
+// the file changed.
+func (m *WSHeartbeat) loadPathsFile(route *BackendRoute) ([]byte, error) {
+	data, err := os.ReadFile(m.BackendPathsFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading backend paths file: %v", err)
+	}
+	list := &pathList{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		p := scanner.Text()
+		// Drop comments and surrounding whitespace.
+		if i := strings.Index(p, "#"); i >= 0 {
+			p = p[:i]
+		}
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		re, err := m.parseFilePath(p)
+		if err != nil {
+			m.logger.Warn("skipping malformed backend path",
+				zap.String("file", m.BackendPathsFile),
+				zap.Int("line", line),
+				zap.Error(err),
+			)
+			continue
+		}
+		list.paths = append(list.paths, p)
+		list.regexps = append(list.regexps, re)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading backend paths file: %v", err)
+	}
+	route.filePaths.Store(list)
+	m.logger.Info("loaded backend paths",
+		zap.String("file", m.BackendPathsFile),
+		zap.Int("paths", len(list.paths)),
+	)
+	return data, nil
+}
+
+// parseFilePath validates a path of BackendPathsFile, returning its compiled regular
+// expression for paths starting with "~".
+func (m *WSHeartbeat) parseFilePath(p string) (*regexp.Regexp, error) {
+	if strings.ContainsAny(p, " \t") {
+		return nil, fmt.Errorf("path contains whitespace: %s", p)
+	}
+	expr, ok := strings.CutPrefix(p, "~")
+	if !ok {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("path must start with / or ~: %s", p)
+		}
+		return nil, nil
+	}
+	if m.matchOptions().CaseInsensitive {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend path regexp %s: %v", p[1:], err)
+	}
+	return re, nil
+}
+
+// reloadPathsFile re-reads BackendPathsFile every reload interval until ctx is done.
+// The paths are only replaced when the file changed, and kept when it can't be read.
+func (m *WSHeartbeat) reloadPathsFile(ctx context.Context, route *BackendRoute, last []byte) {
+	ticker := time.NewTicker(m.reloadIntervalDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		data, err := os.ReadFile(m.BackendPathsFile)
+		if err != nil {
+			m.logger.Error("backend paths file reload failed, keeping the loaded paths",
+				zap.String("file", m.BackendPathsFile),
+				zap.Error(err),
+			)
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		reloaded, err := m.loadPathsFile(route)
+		if err != nil {
+			m.logger.Error("backend paths file reload failed, keeping the loaded paths",
+				zap.String("file", m.BackendPathsFile),
+				zap.Error(err),
+			)
+			continue
+		}
+		last = reloaded
+	}
+}
@@ -0,0 +1,62 @@
+package wsheartbeat
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"net/http"
+	"strings"
+)
+
+// Preflight answers OPTIONS requests to the paths of the routes, which some clients
+// send before upgrading, without involving the backend or the next handlers.
+type Preflight struct {
+	// AllowOrigin is the Access-Control-Allow-Origin of the response, with
+	// placeholders. By default the request's Origin is echoed when Origins allow it.
+	AllowOrigin string `json:"allow_origin,omitempty"`
+	// AllowHeaders are the Access-Control-Allow-Headers of the response.
+	AllowHeaders []string `json:"allow_headers,omitempty"`
+}
+
+// respond answers the OPTIONS request r with 204 No Content.
+func (p *Preflight) respond(w http.ResponseWriter, r *http.Request, m *WSHeartbeat, repl *caddy.Replacer) error {
+	header := w.Header()
+	switch {
+	case p.AllowOrigin != "":
+		header.Set("Access-Control-Allow-Origin", repl.ReplaceAll(p.AllowOrigin, ""))
+	case r.Header.Get("Origin") != "" && m.allowedOrigin(r):
+		header.Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+		header.Add("Vary", "Origin")
+	}
+	header.Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	if len(p.AllowHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(p.AllowHeaders, ", "))
+	}
+	header.Set("Allow", "GET, OPTIONS")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// unmarshalCaddyfile parses the optional block of preflight.
+func (p *Preflight) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "allow_origin":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.AllowOrigin = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "allow_headers":
+			names := d.RemainingArgs()
+			if len(names) == 0 {
+				return d.ArgErr()
+			}
+			p.AllowHeaders = append(p.AllowHeaders, names...)
+		default:
+			return d.Errf("unknown preflight option: %s", d.Val())
+		}
+	}
+	return nil
+}
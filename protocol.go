@@ -0,0 +1,107 @@
+package wsheartbeat
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// graphql-ws subprotocols: the current graphql-transport-ws and the legacy
+// subscriptions-transport-ws, which confusingly uses "graphql-ws".
+const (
+	graphqlTransportWS = "graphql-transport-ws"
+	graphqlLegacyWS    = "graphql-ws"
+)
+
+// sockJSHeartbeat is the SockJS heartbeat frame.
+const sockJSHeartbeat = "h"
+
+// offeredProtocols returns the subprotocols offered in the Sec-WebSocket-Protocol
+// headers of h, in the client's order. Several header lines may each carry a comma
+// separated list; whitespace and repeated offers are dropped.
+func offeredProtocols(h http.Header) []string {
+	var offered []string
+	for _, value := range h.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(value, ",") {
+			p = strings.TrimSpace(p)
+			if p != "" && !slices.Contains(offered, p) {
+				offered = append(offered, p)
+			}
+		}
+	}
+	return offered
+}
+
+// observeProtocol inspects a message read from src on its way to the other side,
+// recording what the heartbeat protocol learns from it.
+func (m *WSHeartbeat) observeProtocol(sess *session, src *leg, msgType int, msg []byte) {
+	switch m.Protocol {
+	case "engineio":
+		// Heartbeat packets prove the sender alive.
+		if isEngineIOHeartbeat(msgType, msg) {
+			src.extendReadDeadline()
+			src.markAlive()
+		}
+	case "sockjs":
+		// Any client traffic proves the client alive; backend heartbeats make ours redundant.
+		if src == &sess.client {
+			src.extendReadDeadline()
+			src.markAlive()
+		} else if msgType == websocket.TextMessage && string(msg) == sockJSHeartbeat {
+			sess.backendBeat.Store(int64(time.Since(monoEpoch)))
+		}
+	}
+}
+
+// protocolBeat returns the keep-alive of the heartbeat protocol for a connection that
+// negotiated subprotocol, or nil when no protocol applies. Replies are awaited for the
+// pong wait of the connection's client heartbeat hb.
+func (m *WSHeartbeat) protocolBeat(subprotocol string, hb heartbeat) *textBeat {
+	protocol := m.Protocol
+	if protocol == "auto" {
+		switch subprotocol {
+		case graphqlTransportWS, graphqlLegacyWS:
+			protocol = "graphql-ws"
+		default:
+			return nil
+		}
+	}
+	switch protocol {
+	case "sockjs":
+		return &textBeat{message: sockJSHeartbeat, fillGaps: true}
+	case "graphql-ws":
+		// The legacy protocol's keep-alive is one-way.
+		if subprotocol == graphqlLegacyWS {
+			return &textBeat{message: `{"type":"ka"}`}
+		}
+		return &textBeat{
+			message: `{"type":"ping"}`,
+			isReply: isGraphQLPong,
+			timeout: hb.pongWait(),
+		}
+	}
+	return nil
+}
+
+// isGraphQLPong reports whether msg is a graphql-transport-ws pong message.
+func isGraphQLPong(msgType int, msg []byte) bool {
+	if msgType != websocket.TextMessage {
+		return false
+	}
+	var message struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(msg, &message) == nil && message.Type == "pong"
+}
+
+// isEngineIOHeartbeat reports whether msg is an Engine.IO ping ("2") or pong ("3")
+// packet, including the "probe" variants sent while upgrading the transport.
+func isEngineIOHeartbeat(msgType int, msg []byte) bool {
+	if msgType != websocket.TextMessage || len(msg) == 0 || (msg[0] != '2' && msg[0] != '3') {
+		return false
+	}
+	return len(msg) == 1 || string(msg[1:]) == "probe"
+}
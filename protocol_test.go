@@ -0,0 +1,35 @@
+package wsheartbeat
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestOfferedProtocols(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{"none", nil, nil},
+		{"single", []string{"chat"}, []string{"chat"}},
+		{"comma separated", []string{"chat, superchat"}, []string{"chat", "superchat"}},
+		{"multiple lines", []string{"chat", "superchat, v2.json"}, []string{"chat", "superchat", "v2.json"}},
+		{"duplicates", []string{"chat, chat", "superchat, chat"}, []string{"chat", "superchat"}},
+		{"whitespace", []string{"  chat ,\tsuperchat  ", " v2 "}, []string{"chat", "superchat", "v2"}},
+		{"empty entries", []string{",chat,,", "", " , "}, []string{"chat"}},
+		{"client order", []string{"b", "a, c"}, []string{"b", "a", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for _, line := range tt.lines {
+				h.Add("Sec-WebSocket-Protocol", line)
+			}
+			if got := offeredProtocols(h); !slices.Equal(got, tt.want) {
+				t.Fatalf("offeredProtocols(%q) = %q, want %q", tt.lines, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package wsheartbeat
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// maxRateLimitIPs is the number of client IPs whose buckets are remembered. The least
+// recently seen ones are forgotten first, starting over with a full bucket.
+const maxRateLimitIPs = 10000
+
+// RateLimit limits the upgrade attempts of each client IP with a token bucket.
+type RateLimit struct {
+	// Events is the number of upgrade attempts allowed per Window, which is also the
+	// largest burst.
+	Events int `json:"events"`
+	// Window is the duration as a string (e.g., "1s", "1m") over which Events are
+	// allowed.
+	Window string `json:"window"`
+
+	// rate is the number of tokens added to a bucket per second.
+	rate float64
+	mu   sync.Mutex
+	// lru orders the buckets from the most to the least recently seen.
+	lru *list.List
+	// buckets indexes the elements of lru by client IP.
+	buckets map[string]*list.Element
+}
+
+// bucket holds the tokens of one client IP.
+type bucket struct {
+	ip     string
+	tokens float64
+	last   time.Time
+}
+
+// provision checks the limit and parses its window.
+func (rl *RateLimit) provision() error {
+	if rl.Events <= 0 {
+		return fmt.Errorf("invalid rate limit events: %d", rl.Events)
+	}
+	window, err := time.ParseDuration(rl.Window)
+	if err != nil || window <= 0 {
+		return fmt.Errorf("invalid rate limit window: %s", rl.Window)
+	}
+	rl.rate = float64(rl.Events) / window.Seconds()
+	rl.lru = list.New()
+	rl.buckets = make(map[string]*list.Element)
+	return nil
+}
+
+// allow takes a token from the bucket of the client IP ip at now. When there is none
+// left, it returns how long until there is.
+func (rl *RateLimit) allow(ip string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	var b *bucket
+	if elem, ok := rl.buckets[ip]; ok {
+		rl.lru.MoveToFront(elem)
+		b = elem.Value.(*bucket)
+		b.tokens = math.Min(float64(rl.Events), b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+		b.last = now
+	} else {
+		if rl.lru.Len() >= maxRateLimitIPs {
+			oldest := rl.lru.Back()
+			rl.lru.Remove(oldest)
+			delete(rl.buckets, oldest.Value.(*bucket).ip)
+		}
+		b = &bucket{ip: ip, tokens: float64(rl.Events), last: now}
+		rl.buckets[ip] = rl.lru.PushFront(b)
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
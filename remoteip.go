@@ -0,0 +1,79 @@
+package wsheartbeat
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// RemoteIPRules restricts the client IPs that may upgrade.
+type RemoteIPRules struct {
+	// Allow, if not empty, lists the only networks (CIDRs or single IPs) allowed.
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists the networks that are rejected, even when Allow has them.
+	Deny []string `json:"deny,omitempty"`
+
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// provision parses the networks of the rules.
+func (rules *RemoteIPRules) provision() error {
+	var err error
+	if rules.allow, err = parsePrefixes(rules.Allow); err != nil {
+		return fmt.Errorf("remote_ip allow: %v", err)
+	}
+	if rules.deny, err = parsePrefixes(rules.Deny); err != nil {
+		return fmt.Errorf("remote_ip deny: %v", err)
+	}
+	return nil
+}
+
+// parsePrefixes parses CIDRs, and single IPs as the network of that IP alone.
+func parsePrefixes(networks []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(networks))
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			addr, err := netip.ParseAddr(network)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP %s: %v", network, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %s: %v", network, err)
+		}
+		// Match IPv4-mapped networks like IPv4 ones, as the client IPs are unmapped.
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// allowed reports whether the client IP ip may upgrade: it must not be in a denied
+// network, and must be in an allowed one when there are any.
+func (rules *RemoteIPRules) allowed(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.WithZone("").Unmap()
+	for _, prefix := range rules.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(rules.allow) == 0 {
+		return true
+	}
+	for _, prefix := range rules.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
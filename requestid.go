@@ -0,0 +1,57 @@
+package wsheartbeat
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// maxRequestIDLength is the longest request ID taken from the client's request.
+const maxRequestIDLength = 128
+
+// newRequestID returns a random version 4 UUID.
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// requestID returns the ID of the upgrade r: the one it carries in the request ID
+// header when usable, or else a new one.
+func (m *WSHeartbeat) requestID(r *http.Request) string {
+	if id := r.Header.Get(m.RequestIDHeader); validRequestID(id) {
+		return id
+	}
+	return newRequestID()
+}
+
+// validRequestID reports whether id is a non-empty, bounded string of printable ASCII
+// characters, safe to log and to send on.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestLogger returns the logger for the upgrade r, with the request ID set on its
+// replacer, if any.
+func (m *WSHeartbeat) requestLogger(r *http.Request) *zap.Logger {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return m.logger
+	}
+	if id, ok := repl.GetString("ws.request_id"); ok && id != "" {
+		return m.logger.With(zap.String("request_id", id))
+	}
+	return m.logger
+}
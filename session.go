@@ -0,0 +1,356 @@
+package wsheartbeat
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pingPayloadPrefix marks ping payloads carrying a send timestamp for RTT measurement.
+const pingPayloadPrefix = "wsh:"
+
+// maxControlPayload is the largest payload a websocket control frame may carry.
+const maxControlPayload = 125
+
+// monoEpoch is the reference for ping timestamps. Durations since it use the
+// monotonic clock, so RTTs are unaffected by wall clock changes.
+var monoEpoch = time.Now()
+
+// session is the state of one proxied websocket connection.
+type session struct {
+	// client is the client leg of the connection.
+	client leg
+	// backend is the backend leg of the connection.
+	backend leg
+	// up is the upstream the backend connection was dialed through.
+	up *upstream
+	// ctx is the context of the upgrade request.
+	ctx context.Context
+	// repl is the replacer of the upgrade request, used for per-ping placeholders.
+	repl *caddy.Replacer
+	// logger logs the events of the connection, tagged with its request ID.
+	logger *zap.Logger
+	// requestID is the ID of the upgrade request, as in {ws.request_id}.
+	requestID string
+	// clientIP is the IP of the client, resolved behind trusted proxies.
+	clientIP string
+	// writeTimeout bounds the writes of control frames.
+	writeTimeout time.Duration
+	// started is when the connection was set up.
+	started time.Time
+	// lastActivity is when a message was last proxied, relative to monoEpoch.
+	lastActivity atomic.Int64
+	// backendBeat is when the backend last sent a protocol heartbeat of its own,
+	// relative to monoEpoch.
+	backendBeat atomic.Int64
+
+	// mu protects closeReason.
+	mu sync.Mutex
+	// closeReason explains why the module closed the connection, if it did.
+	closeReason string
+	// done is closed when the connection is torn down, stopping its heartbeats and
+	// writers.
+	done chan struct{}
+	// finishOnce guards closing done.
+	finishOnce sync.Once
+}
+
+// leg is one side of a proxied connection together with its heartbeat state.
+type leg struct {
+	// name is "client" or "backend", used in logs.
+	name string
+	// conn is the websocket connection of this side.
+	conn *websocket.Conn
+	// missedPongs counts consecutive pings left unanswered past the pong timeout.
+	missedPongs atomic.Int64
+	// rtt is the latest round-trip time from ping to pong, in nanoseconds.
+	rtt atomic.Int64
+	// avgRTT is the smoothed round-trip time, in nanoseconds.
+	avgRTT atomic.Int64
+	// pongs counts pongs echoing one of our pings.
+	pongs atomic.Int64
+	// unexpectedPongs counts pongs whose payload carries no timestamp of ours.
+	unexpectedPongs atomic.Int64
+	// pings counts the pings sent on this leg.
+	pings atomic.Int64
+	// peerPings counts the pings read from this leg, sent by the peer on its own.
+	peerPings atomic.Int64
+	// lastPong is when a pong was last read from this leg, relative to monoEpoch, or
+	// zero if none was.
+	lastPong atomic.Int64
+	// messages counts the messages read from this leg and proxied to the other.
+	messages atomic.Int64
+	// bytes counts the payload bytes of those messages.
+	bytes atomic.Int64
+	// readWindow is how far the read deadline is pushed out by a pong; zero leaves
+	// the deadline unset.
+	readWindow time.Duration
+	// refreshOnRead makes any message read from the peer push the read deadline out,
+	// for when pings may be skipped or suppressed and get no pong.
+	refreshOnRead bool
+	// aliveOnRead makes any message read from the peer prove it alive, and push the
+	// read deadline out, as with unsolicited pong keepalives.
+	aliveOnRead bool
+	// alive signals a pong, or another proof of liveness, read from the peer.
+	alive chan struct{}
+	// textBeat is the application-level heartbeat sent on this leg, if any. Its
+	// replies read from the leg are consumed.
+	textBeat *textBeat
+	// awaitingReply is 1 while a text heartbeat sent on this leg is unanswered. Only
+	// then is a reply consumed, leaving the peer's answers to the other side's own
+	// pings untouched.
+	awaitingReply atomic.Int32
+	// textReplies signals text heartbeat replies read from the peer.
+	textReplies chan struct{}
+	// pingsTo is the leg that pings read from this leg are relayed to, instead of
+	// being answered, if set.
+	pingsTo *leg
+	// pongsTo is the leg that pongs read from this leg are relayed to, when they
+	// answer pings relayed from it rather than our own.
+	pongsTo *leg
+	// relayTimeout is how long a ping relayed to this leg waits for its pong before
+	// the pong is no longer relayed back; zero relays every pong.
+	relayTimeout time.Duration
+	// violations counts the messages read from this leg of a type that isn't allowed.
+	violations atomic.Int64
+	// readLimit is the largest message read from this leg, or zero for no limit.
+	readLimit int64
+	// answerTextPings reports whether text pings read from this leg are answered locally.
+	answerTextPings bool
+
+	// frames and controls queue the data messages and the control frames to the
+	// writer of the leg, which is the only goroutine writing to conn.
+	frames, controls chan frame
+	// done is closed at teardown, stopping the writer.
+	done <-chan struct{}
+
+	// mu protects lastPing, lastPingAt and relayed.
+	mu sync.Mutex
+	// lastPing is the last custom ping payload sent, echoed back by a matching pong.
+	lastPing string
+	// lastPingAt is when lastPing was sent, relative to monoEpoch.
+	lastPingAt time.Duration
+	// relayed maps the payloads of pings relayed to this leg to when they were sent,
+	// relative to monoEpoch. It is only kept with a relay timeout.
+	relayed map[string]time.Duration
+}
+
+// newSession returns the session of a client connection upgraded by the request with
+// ctx and proxied to backend through up. Control frames are written within writeTimeout.
+func newSession(ctx context.Context, client, backend *websocket.Conn, up *upstream, repl *caddy.Replacer, writeTimeout time.Duration) *session {
+	sess := &session{ctx: ctx, up: up, repl: repl, logger: zap.NewNop(), writeTimeout: writeTimeout, started: time.Now()}
+	sess.client.name, sess.client.conn = "client", client
+	sess.backend.name, sess.backend.conn = "backend", backend
+	sess.client.alive = make(chan struct{}, 1)
+	sess.backend.alive = make(chan struct{}, 1)
+	sess.client.textReplies = make(chan struct{}, 1)
+	sess.backend.textReplies = make(chan struct{}, 1)
+	sess.done = make(chan struct{})
+	sess.client.startWriter(sess.done)
+	sess.backend.startWriter(sess.done)
+	sess.client.handleClose(writeTimeout)
+	sess.backend.handleClose(writeTimeout)
+	sess.touch()
+	return sess
+}
+
+// finish tears the session down, stopping its heartbeats and the writers of its
+// legs. Writes queued afterwards fail.
+func (s *session) finish() {
+	s.finishOnce.Do(func() { close(s.done) })
+}
+
+// close records reason, then closes both connections with a close frame carrying
+// code and text. Only the first recorded reason is kept.
+func (s *session) close(code int, reason, text string) {
+	s.mu.Lock()
+	if s.closeReason == "" {
+		s.closeReason = reason
+	}
+	s.mu.Unlock()
+	s.client.closeLeg(code, text, s.writeTimeout)
+	s.backend.closeLeg(code, text, s.writeTimeout)
+}
+
+// closeOffender records reason, then closes the connection of offender, a leg of s,
+// with a close frame carrying code and text, and the other one normally.
+func (s *session) closeOffender(offender *leg, code int, reason, text string) {
+	s.mu.Lock()
+	if s.closeReason == "" {
+		s.closeReason = reason
+	}
+	s.mu.Unlock()
+	other := &s.backend
+	if offender == &s.backend {
+		other = &s.client
+	}
+	offender.closeLeg(code, text, s.writeTimeout)
+	other.closeLeg(websocket.CloseNormalClosure, "", s.writeTimeout)
+}
+
+// reason returns why the module closed the connection, or "" if it didn't.
+func (s *session) reason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeReason
+}
+
+// touch records that a message was just proxied.
+func (s *session) touch() {
+	s.lastActivity.Store(int64(time.Since(monoEpoch)))
+}
+
+// idle returns how long ago a message was last proxied, or since the connection was
+// set up if none was.
+func (s *session) idle() time.Duration {
+	return time.Since(monoEpoch) - time.Duration(s.lastActivity.Load())
+}
+
+// fields returns the statistics of the connection as log fields. Bytes and messages
+// in are read from the client, out from the backend.
+func (s *session) fields() []zap.Field {
+	return []zap.Field{
+		zap.Duration("duration", time.Since(s.started)),
+		zap.Int64("messages_in", s.client.messages.Load()),
+		zap.Int64("messages_out", s.backend.messages.Load()),
+		zap.Int64("bytes_in", s.client.bytes.Load()),
+		zap.Int64("bytes_out", s.backend.bytes.Load()),
+	}
+}
+
+// markAlive signals that the peer of the leg proved to be alive, without blocking.
+func (l *leg) markAlive() {
+	select {
+	case l.alive <- struct{}{}:
+	default:
+	}
+}
+
+// extendReadDeadline pushes the read deadline of the leg out by its read window. The
+// deadline is set on the underlying connection, which is safe from any goroutine.
+func (l *leg) extendReadDeadline() {
+	if l.readWindow > 0 {
+		_ = l.conn.NetConn().SetReadDeadline(time.Now().Add(l.readWindow))
+	}
+}
+
+// fields returns the heartbeat statistics of the leg as log fields, prefixed with
+// prefix.
+func (l *leg) fields(prefix string) []zap.Field {
+	return []zap.Field{
+		zap.Int64(prefix+"pings", l.pings.Load()),
+		zap.Int64(prefix+"pings_received", l.peerPings.Load()),
+		zap.Int64(prefix+"missed_pongs", l.missedPongs.Load()),
+		zap.Duration(prefix+"rtt", time.Duration(l.rtt.Load())),
+		zap.Duration(prefix+"avg_rtt", time.Duration(l.avgRTT.Load())),
+		zap.Int64(prefix+"pongs", l.pongs.Load()),
+		zap.Int64(prefix+"unexpected_pongs", l.unexpectedPongs.Load()),
+		zap.Duration(prefix+"last_pong_age", l.lastPongAge()),
+	}
+}
+
+// lastPongAge returns how long ago a pong was last read from the leg, or zero if
+// none was.
+func (l *leg) lastPongAge() time.Duration {
+	last := l.lastPong.Load()
+	if last == 0 {
+		return 0
+	}
+	return time.Since(monoEpoch) - time.Duration(last)
+}
+
+// pingPayload returns the payload of the next ping: the custom payload when given,
+// with placeholders replaced by repl, or else one stamped with the current monotonic time.
+func (l *leg) pingPayload(custom string, repl *caddy.Replacer) []byte {
+	now := time.Since(monoEpoch)
+	if custom == "" {
+		payload := make([]byte, len(pingPayloadPrefix)+8)
+		copy(payload, pingPayloadPrefix)
+		binary.BigEndian.PutUint64(payload[len(pingPayloadPrefix):], uint64(now))
+		return payload
+	}
+	payload := repl.ReplaceKnown(custom, "")
+	// Control frames carry at most 125 bytes.
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	// Remember the payload so its pong still yields an RTT.
+	l.mu.Lock()
+	l.lastPing, l.lastPingAt = payload, now
+	l.mu.Unlock()
+	return []byte(payload)
+}
+
+// recordPong measures the round-trip time from the timestamp echoed in appData. It
+// reports false when appData isn't one of our payloads.
+func (l *leg) recordPong(appData string) (time.Duration, bool) {
+	var sent time.Duration
+	if len(appData) == len(pingPayloadPrefix)+8 && strings.HasPrefix(appData, pingPayloadPrefix) {
+		sent = time.Duration(binary.BigEndian.Uint64([]byte(appData[len(pingPayloadPrefix):])))
+	} else {
+		// A custom payload is matched against the last ping sent.
+		l.mu.Lock()
+		matched := l.lastPingAt > 0 && appData == l.lastPing
+		sent = l.lastPingAt
+		l.mu.Unlock()
+		if !matched {
+			return 0, false
+		}
+	}
+	rtt := time.Since(monoEpoch) - sent
+	if rtt < 0 {
+		return 0, false
+	}
+	l.rtt.Store(int64(rtt))
+	// Smooth the average like TCP's SRTT, weighting each new sample by 1/8.
+	if l.pongs.Add(1) == 1 {
+		l.avgRTT.Store(int64(rtt))
+	} else {
+		avg := l.avgRTT.Load()
+		l.avgRTT.Store(avg + (int64(rtt)-avg)/8)
+	}
+	return rtt, true
+}
+
+// noteRelayed records that a ping with appData was relayed to the leg, so its pong
+// can be matched within the relay timeout.
+func (l *leg) noteRelayed(appData string) {
+	if l.relayTimeout == 0 {
+		return
+	}
+	now := time.Since(monoEpoch)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.relayed == nil {
+		l.relayed = make(map[string]time.Duration)
+	}
+	// Forget the pings whose pongs can no longer be relayed.
+	for payload, at := range l.relayed {
+		if now-at > l.relayTimeout {
+			delete(l.relayed, payload)
+		}
+	}
+	l.relayed[appData] = now
+}
+
+// takeRelayed reports whether a pong with appData read from the leg answers a ping
+// relayed to it within the relay timeout, forgetting the ping.
+func (l *leg) takeRelayed(appData string) bool {
+	if l.relayTimeout == 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	at, ok := l.relayed[appData]
+	if !ok {
+		return false
+	}
+	delete(l.relayed, appData)
+	return time.Since(monoEpoch)-at <= l.relayTimeout
+}
@@ -0,0 +1,153 @@
+package wsheartbeat
+
+import (
+	"context"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// connPair returns both ends of a websocket connection: the one upgraded by the
+// server, and the one dialed by the client.
+func connPair(t testing.TB) (server, client *websocket.Conn) {
+	t.Helper()
+	upgraded := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		upgraded <- conn
+	}))
+	defer srv.Close()
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return <-upgraded, client
+}
+
+// testSession returns a session proxying the server ends of two connection pairs,
+// along with the client ends standing for the client and the backend.
+func testSession(t testing.TB) (sess *session, client, backend *websocket.Conn) {
+	t.Helper()
+	clientSide, client := connPair(t)
+	backendSide, backend := connPair(t)
+	sess = newSession(context.Background(), clientSide, backendSide, nil, caddy.NewReplacer(), time.Second)
+	return sess, client, backend
+}
+
+// testHeartbeat returns a handler sending pings within a second.
+func testHeartbeat() *WSHeartbeat {
+	return &WSHeartbeat{keepaliveFrameType: websocket.PingMessage, pingWriteTimeoutDuration: time.Second}
+}
+
+func TestWritesSerializedWithPings(t *testing.T) {
+	m := testHeartbeat()
+	sess, client, backend := testSession(t)
+	defer sess.finish()
+	defer client.Close()
+	defer backend.Close()
+
+	// Ping the client as fast as possible while several writers hammer data at it.
+	// Concurrent writes would trip the race detector or gorilla/websocket's own check.
+	var pings atomic.Int64
+	client.SetPingHandler(func(appData string) error {
+		pings.Add(1)
+		return client.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+	})
+	m.handlePongs(sess, &sess.client)
+	go m.handlePing(sess, &sess.client, heartbeat{interval: time.Millisecond})
+
+	const writers, messages = 4, 500
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range messages {
+				if err := sess.client.write(websocket.TextMessage, []byte(fmt.Sprintf("%d-%d", w, i))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	// Each writer's messages must arrive whole and in order.
+	next := make([]int, writers)
+	for range writers * messages {
+		_, msg, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var w, i int
+		if _, err := fmt.Sscanf(string(msg), "%d-%d", &w, &i); err != nil || w >= writers || i != next[w] {
+			t.Fatalf("got message %q, want %d-%d", msg, w, next[w])
+		}
+		next[w]++
+	}
+	wg.Wait()
+	// Read on until a few more pings got through behind the data.
+	seen := pings.Load()
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	waitFor(t, "pings", func() bool { return pings.Load() > seen+2 })
+}
+
+func TestWritesFailAfterFinish(t *testing.T) {
+	sess, client, backend := testSession(t)
+	defer client.Close()
+	defer backend.Close()
+	sess.finish()
+	if err := sess.client.write(websocket.TextMessage, []byte("late")); err != errSessionDone {
+		t.Fatalf("write after finish = %v, want errSessionDone", err)
+	}
+	if err := sess.backend.writeControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != errSessionDone {
+		t.Fatalf("control write after finish = %v, want errSessionDone", err)
+	}
+}
+
+func TestHeartbeatsStopOnTeardown(t *testing.T) {
+	m := testHeartbeat()
+	cycle := func() {
+		sess, client, backend := testSession(t)
+		// The pings are an hour apart, so only teardown can stop their goroutines.
+		hb := heartbeat{interval: time.Hour}
+		for _, l := range []*leg{&sess.client, &sess.backend} {
+			m.handlePongs(sess, l)
+			m.handlePings(sess, l)
+			go m.handlePing(sess, l, hb)
+		}
+		sess.backend.textBeat = &textBeat{message: "ping"}
+		go m.handleTextHeartbeat(sess, &sess.backend, time.Hour)
+		_ = sess.client.conn.Close()
+		_ = sess.backend.conn.Close()
+		sess.finish()
+		_ = client.Close()
+		_ = backend.Close()
+	}
+	// Warm up the goroutines shared by the connections before counting.
+	cycle()
+	time.Sleep(50 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+	for range 1000 {
+		cycle()
+	}
+	waitFor(t, "the heartbeat goroutines to stop", func() bool {
+		return runtime.NumGoroutine() <= baseline+5
+	})
+}
@@ -0,0 +1,96 @@
+package wsheartbeat
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// srvEntry is a cached SRV lookup result.
+type srvEntry struct {
+	// records are the SRV records as returned by the resolver.
+	records []*net.SRV
+	// expires is when the records must be looked up again.
+	expires time.Time
+}
+
+// lookupSRV returns the SRV records of name, served from the cache while fresh.
+func (m *WSHeartbeat) lookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	m.srvMu.Lock()
+	entry, ok := m.srvCache[name]
+	m.srvMu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.records, nil
+	}
+
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	m.srvMu.Lock()
+	m.srvCache[name] = srvEntry{records: records, expires: time.Now().Add(m.srvCacheTTLDuration)}
+	m.srvMu.Unlock()
+	return records, nil
+}
+
+// srvTargets resolves an SRV backend target into one target per SRV record,
+// ordered by priority and, within a priority, randomly by weight.
+func (m *WSHeartbeat) srvTargets(ctx context.Context, t backendTarget) ([]backendTarget, error) {
+	records, err := m.lookupSRV(ctx, t.addr)
+	if err != nil {
+		return nil, err
+	}
+	ordered := orderSRV(records)
+	targets := make([]backendTarget, 0, len(ordered))
+	for _, rec := range ordered {
+		target := t
+		target.srv = false
+		target.addr = net.JoinHostPort(strings.TrimSuffix(rec.Target, "."), strconv.Itoa(int(rec.Port)))
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// orderSRV returns a copy of records ordered as described in RFC 2782: ascending
+// priority, then weighted random order within each priority.
+func orderSRV(records []*net.SRV) []*net.SRV {
+	ordered := make([]*net.SRV, 0, len(records))
+	remaining := append([]*net.SRV(nil), records...)
+	for len(remaining) > 0 {
+		// Collect the records sharing the lowest remaining priority.
+		lowest := remaining[0].Priority
+		for _, rec := range remaining {
+			lowest = min(lowest, rec.Priority)
+		}
+		var group, rest []*net.SRV
+		for _, rec := range remaining {
+			if rec.Priority == lowest {
+				group = append(group, rec)
+			} else {
+				rest = append(rest, rec)
+			}
+		}
+		// Pick records one at a time with probability proportional to their weight.
+		for len(group) > 0 {
+			total := 0
+			for _, rec := range group {
+				total += int(rec.Weight)
+			}
+			i := 0
+			if total > 0 {
+				n := rand.IntN(total)
+				for n >= int(group[i].Weight) {
+					n -= int(group[i].Weight)
+					i++
+				}
+			}
+			ordered = append(ordered, group[i])
+			group = append(group[:i], group[i+1:]...)
+		}
+		remaining = rest
+	}
+	return ordered
+}
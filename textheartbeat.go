@@ -0,0 +1,190 @@
+package wsheartbeat
+
+import (
+	"context"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"regexp"
+	"time"
+)
+
+// defaultTextHeartbeatMessage is sent by text heartbeats without a configured message.
+const defaultTextHeartbeatMessage = `{"type":"ping"}`
+
+// textBeat is an application-level heartbeat exchanged on one leg.
+type textBeat struct {
+	// message is the text frame sent each interval. Known placeholders are replaced.
+	message string
+	// probe, if set, makes the message sent each interval instead, as with heartbeat
+	// protocol modules.
+	probe func(ctx context.Context) (msgType int, payload []byte)
+	// isReply recognizes the peer's answers, which are consumed instead of proxied.
+	// It is nil when the peer doesn't answer.
+	isReply func(msgType int, msg []byte) bool
+	// timeout is how long to wait for a reply; zero disables the wait.
+	timeout time.Duration
+	// fillGaps skips the heartbeat when the backend sent one of its own within the
+	// interval, so the client doesn't get duplicates.
+	fillGaps bool
+}
+
+// TextHeartbeat configures application-level heartbeats: a text message sent every
+// interval, for peers that can't see protocol pings (such as browser JavaScript).
+type TextHeartbeat struct {
+	// Message is the text frame sent each interval (default `{"type":"ping"}`).
+	// Known placeholders are replaced per message; other braces, as in JSON, are kept.
+	Message string `json:"message,omitempty"`
+	// Reply is a regular expression recognizing the peer's answer. Matching text
+	// messages are consumed instead of being proxied.
+	Reply string `json:"reply,omitempty"`
+	// reply is the compiled Reply.
+	reply *regexp.Regexp
+	// Timeout is how long to wait for a reply as a string (e.g., "10s"). A peer that
+	// doesn't reply in time is disconnected. It requires Reply.
+	Timeout string `json:"timeout,omitempty"`
+	// timeoutDuration is the parsed duration of Timeout.
+	timeoutDuration time.Duration
+	// Backend also sends the text heartbeat to the backend, at the backend interval.
+	Backend bool `json:"backend,omitempty"`
+	// beat is the heartbeat sent on each leg.
+	beat *textBeat
+}
+
+// provision compiles the reply pattern and parses the timeout.
+func (t *TextHeartbeat) provision() error {
+	if t.Message == "" {
+		t.Message = defaultTextHeartbeatMessage
+	}
+	t.reply = nil
+	if t.Reply != "" {
+		re, err := regexp.Compile(t.Reply)
+		if err != nil {
+			return fmt.Errorf("invalid text heartbeat reply: %v", err)
+		}
+		t.reply = re
+	}
+	t.timeoutDuration = 0
+	if t.Timeout != "" {
+		if t.reply == nil {
+			return fmt.Errorf("text heartbeat timeout requires a reply pattern")
+		}
+		dur, err := time.ParseDuration(t.Timeout)
+		if err != nil || dur <= 0 {
+			return fmt.Errorf("invalid text heartbeat timeout: %s", t.Timeout)
+		}
+		t.timeoutDuration = dur
+	}
+	t.beat = &textBeat{message: t.Message, timeout: t.timeoutDuration}
+	if t.reply != nil {
+		t.beat.isReply = func(msgType int, msg []byte) bool {
+			return msgType == websocket.TextMessage && t.reply.Match(msg)
+		}
+	}
+	return nil
+}
+
+// unmarshalCaddyfile parses the optional message argument and block of text_heartbeat.
+func (t *TextHeartbeat) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		t.Message = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "message":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Message = d.Val()
+		case "reply":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Reply = d.Val()
+		case "timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Timeout = d.Val()
+		case "backend":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Backend = true
+		default:
+			return d.Errf("unknown text_heartbeat option: %s", d.Val())
+		}
+	}
+	return nil
+}
+
+// handleTextHeartbeat sends the text heartbeat of one leg of sess every interval.
+// With a timeout, a peer that doesn't reply in time is disconnected together with
+// the other leg. It returns as soon as sess is torn down.
+func (m *WSHeartbeat) handleTextHeartbeat(sess *session, l *leg, interval time.Duration) {
+	t := l.textBeat
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// replyTimer runs from the first unanswered heartbeat until a reply arrives.
+	var replyTimer *time.Timer
+	var replyDeadline <-chan time.Time
+	defer func() {
+		if replyTimer != nil {
+			replyTimer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-sess.done:
+			return
+		case <-ticker.C:
+			if t.fillGaps && time.Since(monoEpoch)-time.Duration(sess.backendBeat.Load()) < interval {
+				continue
+			}
+			msgType, msg := websocket.TextMessage, []byte(sess.repl.ReplaceKnown(t.message, ""))
+			if t.probe != nil {
+				msgType, msg = t.probe(sess.ctx)
+			}
+			// Expect the reply before sending, as it may arrive before the write returns.
+			if t.isReply != nil {
+				l.awaitingReply.Store(1)
+			}
+			var err error
+			if msgType == websocket.PingMessage || msgType == websocket.PongMessage {
+				err = l.writeControl(msgType, msg, time.Now().Add(sess.writeTimeout))
+			} else {
+				err = l.write(msgType, msg)
+			}
+			if err != nil {
+				sess.logger.Debug("Failed to send text heartbeat", zap.String("to", l.name), zap.Error(err))
+				return
+			}
+			sess.logger.Debug("Sent text heartbeat", zap.String("to", l.name))
+			// Start waiting for the reply, unless an earlier heartbeat is still unanswered.
+			if t.timeout > 0 && replyTimer == nil {
+				replyTimer = time.NewTimer(t.timeout)
+				replyDeadline = replyTimer.C
+			}
+		case <-l.textReplies:
+			sess.logger.Debug("Received text heartbeat reply", zap.String("from", l.name))
+			if replyTimer != nil {
+				replyTimer.Stop()
+				replyTimer, replyDeadline = nil, nil
+			}
+		case <-replyDeadline:
+			sess.logger.Warn("no text heartbeat reply received within timeout, closing connection",
+				zap.String("from", l.name),
+				zap.String("remote_addr", l.conn.RemoteAddr().String()),
+				zap.Duration("timeout", t.timeout),
+			)
+			m.closeForHeartbeat(sess, l.name+" missed text heartbeat reply")
+			return
+		}
+	}
+}
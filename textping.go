@@ -0,0 +1,84 @@
+package wsheartbeat
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/gorilla/websocket"
+)
+
+// TextPingResponder answers application-level text pings locally, so the other side
+// of the proxy never sees them.
+type TextPingResponder struct {
+	// Request is the exact text message recognized as a ping (default "ping").
+	Request string `json:"request,omitempty"`
+	// Response is the text message sent back (default "pong").
+	Response string `json:"response,omitempty"`
+	// From lists the sides whose pings are answered: "client" (default), "backend",
+	// or both.
+	From []string `json:"from,omitempty"`
+	// fromClient and fromBackend are the parsed From.
+	fromClient, fromBackend bool
+}
+
+// provision applies the defaults and validates the directions.
+func (t *TextPingResponder) provision() error {
+	if t.Request == "" {
+		t.Request = "ping"
+	}
+	if t.Response == "" {
+		t.Response = "pong"
+	}
+	t.fromClient, t.fromBackend = len(t.From) == 0, false
+	for _, from := range t.From {
+		switch from {
+		case "client":
+			t.fromClient = true
+		case "backend":
+			t.fromBackend = true
+		default:
+			return fmt.Errorf("respond_to_text_ping: unknown direction %s, must be client or backend", from)
+		}
+	}
+	return nil
+}
+
+// isPing reports whether a message read from a peer is a text ping to answer.
+func (t *TextPingResponder) isPing(msgType int, msg []byte) bool {
+	return msgType == websocket.TextMessage && string(msg) == t.Request
+}
+
+// unmarshalCaddyfile parses the optional request and response arguments and the
+// block of respond_to_text_ping.
+func (t *TextPingResponder) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	switch len(args) {
+	case 0:
+	case 2:
+		t.Request, t.Response = args[0], args[1]
+	default:
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "request":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Request = d.Val()
+		case "response":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.Response = d.Val()
+		case "from":
+			from := d.RemainingArgs()
+			if len(from) == 0 {
+				return d.ArgErr()
+			}
+			t.From = append(t.From, from...)
+		default:
+			return d.Errf("unknown respond_to_text_ping option: %s", d.Val())
+		}
+	}
+	return nil
+}
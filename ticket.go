@@ -0,0 +1,171 @@
+package wsheartbeat
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTicketNonces is the number of unexpired ticket nonces remembered for replay
+// protection. Tickets with new nonces are rejected while it is reached.
+const maxTicketNonces = 100000
+
+// Ticket requires a short-lived ticket signed by the application on upgrades, a
+// lighter alternative to JWT. A ticket is "<expiry>.<hmac>", or "<expiry>.<nonce>.<hmac>"
+// with replay protection, where expiry is a Unix time in seconds and hmac is the
+// hex-encoded HMAC-SHA256, keyed with Secret, of everything before its dot.
+type Ticket struct {
+	// Secret is the key shared with the application issuing the tickets.
+	Secret string `json:"secret"`
+	// Query is the query parameter carrying the ticket (default ticket).
+	Query string `json:"query,omitempty"`
+	// Header, if set, is the header carrying the ticket instead.
+	Header string `json:"header,omitempty"`
+	// ClockSkew is how long past its expiry a ticket is still accepted, as a duration
+	// string (default "30s").
+	ClockSkew string `json:"clock_skew,omitempty"`
+	// ReplayProtection requires a nonce in tickets, and accepts each only once.
+	ReplayProtection bool `json:"replay_protection,omitempty"`
+
+	clockSkew time.Duration
+	mu        sync.Mutex
+	// nonces maps the nonces of the accepted tickets to when they can be forgotten,
+	// once their tickets have expired.
+	nonces map[string]time.Time
+}
+
+// provision checks the ticket configuration and parses its clock skew.
+func (t *Ticket) provision() error {
+	if t.Secret == "" {
+		return fmt.Errorf("ticket: secret must be specified")
+	}
+	if t.Query != "" && t.Header != "" {
+		return fmt.Errorf("ticket: query and header are exclusive")
+	}
+	if t.Query == "" && t.Header == "" {
+		t.Query = "ticket"
+	}
+	t.clockSkew = 30 * time.Second
+	if t.ClockSkew != "" {
+		dur, err := time.ParseDuration(t.ClockSkew)
+		if err != nil || dur < 0 {
+			return fmt.Errorf("invalid ticket clock skew: %s", t.ClockSkew)
+		}
+		t.clockSkew = dur
+	}
+	t.nonces = make(map[string]time.Time)
+	return nil
+}
+
+// verify checks the ticket of the upgrade r at now.
+func (t *Ticket) verify(r *http.Request, now time.Time) error {
+	raw := r.URL.Query().Get(t.Query)
+	if t.Header != "" {
+		raw = r.Header.Get(t.Header)
+	}
+	if raw == "" {
+		return fmt.Errorf("missing ticket")
+	}
+	i := strings.LastIndexByte(raw, '.')
+	if i < 0 {
+		return fmt.Errorf("malformed ticket")
+	}
+	signed, sig := raw[:i], raw[i+1:]
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("malformed ticket signature")
+	}
+	mac := hmac.New(sha256.New, []byte(t.Secret))
+	mac.Write([]byte(signed))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return fmt.Errorf("invalid ticket signature")
+	}
+
+	expiryField, nonce, hasNonce := strings.Cut(signed, ".")
+	seconds, err := strconv.ParseInt(expiryField, 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed ticket expiry")
+	}
+	expiry := time.Unix(seconds, 0)
+	if now.After(expiry.Add(t.clockSkew)) {
+		return fmt.Errorf("expired ticket")
+	}
+	if !t.ReplayProtection {
+		return nil
+	}
+	if !hasNonce || nonce == "" {
+		return fmt.Errorf("ticket without nonce")
+	}
+	return t.useNonce(nonce, expiry.Add(t.clockSkew), now)
+}
+
+// useNonce records that the nonce of a ticket valid until expires was used at now,
+// failing if it already was.
+func (t *Ticket) useNonce(nonce string, expires, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.nonces[nonce]; ok {
+		return fmt.Errorf("replayed ticket")
+	}
+	if len(t.nonces) >= maxTicketNonces {
+		// Forget the nonces of expired tickets, which can't be replayed anyway.
+		for n, until := range t.nonces {
+			if now.After(until) {
+				delete(t.nonces, n)
+			}
+		}
+		if len(t.nonces) >= maxTicketNonces {
+			return fmt.Errorf("too many unexpired tickets")
+		}
+	}
+	t.nonces[nonce] = expires
+	return nil
+}
+
+// unmarshalCaddyfile parses the block of ticket.
+func (t *Ticket) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		switch option {
+		case "secret", "query", "header", "clock_skew":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch option {
+			case "secret":
+				t.Secret = d.Val()
+			case "query":
+				t.Query = d.Val()
+			case "header":
+				t.Header = d.Val()
+			case "clock_skew":
+				t.ClockSkew = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "replay_protection":
+			// Parse the optional on/off flag; no argument means on.
+			t.ReplayProtection = true
+			if d.NextArg() {
+				switch d.Val() {
+				case "on":
+				case "off":
+					t.ReplayProtection = false
+				default:
+					return d.Errf("replay_protection must be on or off, got %s", d.Val())
+				}
+			}
+		default:
+			return d.Errf("unknown ticket option: %s", option)
+		}
+	}
+	return nil
+}
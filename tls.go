@@ -0,0 +1,97 @@
+package wsheartbeat
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// provisionTLS validates the TLS options and builds the TLS client configuration for wss backends.
+func (m *WSHeartbeat) provisionTLS() error {
+	// TLS options only make sense for wss backends.
+	if !m.hasScheme("wss") {
+		if m.InsecureSkipVerify {
+			return fmt.Errorf("insecure_skip_verify requires a wss:// backend host")
+		}
+		if len(m.TrustedCACerts) > 0 {
+			return fmt.Errorf("trusted_ca_certs requires a wss:// backend host")
+		}
+		if m.ClientCertificateFile != "" || m.ClientCertificateKeyFile != "" {
+			return fmt.Errorf("client certificates require a wss:// backend host")
+		}
+		if m.TLSServerName != "" {
+			return fmt.Errorf("tls_server_name requires a wss:// backend host")
+		}
+		return nil
+	}
+
+	// An empty ServerName lets the dialer derive it from the backend host without its port.
+	m.tlsConfig = &tls.Config{
+		ServerName:         m.TLSServerName,
+		InsecureSkipVerify: m.InsecureSkipVerify,
+	}
+	if m.InsecureSkipVerify {
+		m.logger.Warn("TLS certificate verification of the backend is disabled; do not use insecure_skip_verify in production")
+	}
+
+	// Load the trusted CA certificates into a dedicated pool.
+	if len(m.TrustedCACerts) > 0 {
+		pool := x509.NewCertPool()
+		for _, entry := range m.TrustedCACerts {
+			pemData, err := loadPEM(entry)
+			if err != nil {
+				return fmt.Errorf("loading trusted CA certificates: %v", err)
+			}
+			if !pool.AppendCertsFromPEM(pemData) {
+				return fmt.Errorf("no certificates found in trusted CA %s", describePEM(entry))
+			}
+		}
+		m.tlsConfig.RootCAs = pool
+	}
+
+	// Load the client certificate presented to backends that require mutual TLS.
+	if m.ClientCertificateFile != "" || m.ClientCertificateKeyFile != "" {
+		if m.ClientCertificateFile == "" || m.ClientCertificateKeyFile == "" {
+			return fmt.Errorf("client_certificate_file and client_certificate_key_file must be specified together")
+		}
+		cert, err := tls.LoadX509KeyPair(m.ClientCertificateFile, m.ClientCertificateKeyFile)
+		if err != nil {
+			return fmt.Errorf("loading client certificate key pair: %v", err)
+		}
+		m.tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return nil
+}
+
+// loadPEM returns the PEM data of entry, which is either inline PEM or a path to a PEM file.
+func loadPEM(entry string) ([]byte, error) {
+	if strings.Contains(entry, "-----BEGIN") {
+		return []byte(entry), nil
+	}
+	return os.ReadFile(entry)
+}
+
+// describePEM returns a short description of a PEM entry suitable for error messages.
+func describePEM(entry string) string {
+	if strings.Contains(entry, "-----BEGIN") {
+		return "(inline PEM)"
+	}
+	return entry
+}
+
+// withServerName returns a copy of base (which may be nil) whose ServerName is the
+// host portion of host.
+func withServerName(base *tls.Config, host string) *tls.Config {
+	cfg := &tls.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	cfg.ServerName = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return cfg
+}
@@ -0,0 +1,217 @@
+package wsheartbeat
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// HostList is a list of backend hosts. In JSON it may also be given as a single string.
+type HostList []string
+
+// UnmarshalJSON accepts either a single host string or a list of hosts.
+func (l *HostList) UnmarshalJSON(b []byte) error {
+	var host string
+	if err := json.Unmarshal(b, &host); err == nil {
+		*l = HostList{host}
+		return nil
+	}
+	var hosts []string
+	if err := json.Unmarshal(b, &hosts); err != nil {
+		return err
+	}
+	*l = hosts
+	return nil
+}
+
+// MarshalJSON encodes a single host as a plain string for backward compatibility.
+func (l HostList) MarshalJSON() ([]byte, error) {
+	if len(l) == 1 {
+		return json.Marshal(l[0])
+	}
+	return json.Marshal([]string(l))
+}
+
+// String returns the hosts separated by spaces.
+func (l HostList) String() string {
+	return strings.Join(l, " ")
+}
+
+// upstream is one backend host of a route.
+type upstream struct {
+	// host is the configured backend host.
+	host string
+	// target is the parsed host.
+	target backendTarget
+	// dynamic reports whether host contains placeholders.
+	dynamic bool
+	// weight is the relative share of new connections; zero drains the upstream.
+	weight int
+	// currentWeight is the smooth weighted round-robin state, protected by the
+	// route's wrrMu.
+	currentWeight int
+	// conns is the number of active (or being dialed) proxied connections.
+	conns atomic.Int64
+	// unhealthy reports whether the upstream failed its last active health check.
+	unhealthy atomic.Bool
+	// breaker takes the upstream out of rotation after repeated dial failures.
+	breaker breaker
+}
+
+// available reports whether the upstream may receive new connections.
+func (m *WSHeartbeat) available(up *upstream) bool {
+	// A zero weight drains the upstream: existing connections stay, new ones go elsewhere.
+	if up.weight == 0 || up.unhealthy.Load() {
+		return false
+	}
+	// Skip upstreams at their connection cap.
+	if m.MaxConnsPerUpstream > 0 && up.conns.Load() >= int64(m.MaxConnsPerUpstream) {
+		return false
+	}
+	return m.failDurationValue == 0 || up.breaker.eligible(time.Now())
+}
+
+// acquire counts a new connection on up, failing when that would exceed max
+// (zero means no cap). Concurrent upgrades can't overshoot the cap.
+func (up *upstream) acquire(max int) bool {
+	for {
+		conns := up.conns.Load()
+		if max > 0 && conns >= int64(max) {
+			return false
+		}
+		if up.conns.CompareAndSwap(conns, conns+1) {
+			return true
+		}
+	}
+}
+
+// allUpstreams returns the upstreams of every route followed by the dynamic upstreams seen so far.
+func (m *WSHeartbeat) allUpstreams() []*upstream {
+	var ups []*upstream
+	for _, route := range m.routes {
+		ups = append(ups, route.upstreams...)
+	}
+	m.dynamicMu.Lock()
+	for _, up := range m.dynamicPool {
+		ups = append(ups, up)
+	}
+	m.dynamicMu.Unlock()
+	return ups
+}
+
+// dynamicUpstreams returns the upstreams reported by the dynamic upstream source for r.
+// Upstreams seen before are reused so that their connection counts and circuit
+// breakers carry over between connections.
+func (m *WSHeartbeat) dynamicUpstreams(r *http.Request) ([]*upstream, error) {
+	sourced, err := m.upstreamSource.GetUpstreams(r)
+	if err != nil {
+		return nil, err
+	}
+	m.dynamicMu.Lock()
+	defer m.dynamicMu.Unlock()
+	ups := make([]*upstream, 0, len(sourced))
+	for _, u := range sourced {
+		host := m.UpstreamsScheme + "://" + u.Dial
+		up, ok := m.dynamicPool[host]
+		if !ok {
+			target, err := parseBackendHost(host)
+			if err != nil {
+				return nil, err
+			}
+			up = &upstream{host: host, target: target, weight: 1}
+			m.dynamicPool[host] = up
+		}
+		ups = append(ups, up)
+	}
+	return ups, nil
+}
+
+// selectUpstreams returns the available upstreams among ups to try for route, in
+// order, according to the load balancing policy.
+func (m *WSHeartbeat) selectUpstreams(route *BackendRoute, ups []*upstream, r *http.Request) []*upstream {
+	// Skip upstreams that are down.
+	var candidates []*upstream
+	for _, up := range ups {
+		if m.available(up) {
+			candidates = append(candidates, up)
+		}
+	}
+	n := uint64(len(candidates))
+	if n == 0 {
+		return nil
+	}
+	switch m.LBPolicy {
+	case "first":
+		// Fail over through the hosts in configuration order.
+		return candidates
+	case "least_conn":
+		// Pick the host with the fewest connections, breaking ties randomly.
+		var best *upstream
+		var bestConns int64
+		ties := 0
+		for _, up := range candidates {
+			conns := up.conns.Load()
+			switch {
+			case best == nil || conns < bestConns:
+				best, bestConns, ties = up, conns, 1
+			case conns == bestConns:
+				ties++
+				if rand.IntN(ties) == 0 {
+					best = up
+				}
+			}
+		}
+		return []*upstream{best}
+	case "ip_hash":
+		// Rendezvous hashing: the host scoring highest for the client IP wins, so
+		// removing a host only remaps the clients that were on it.
+		ip := m.clientIP(r)
+		var best *upstream
+		var bestScore uint64
+		for _, up := range candidates {
+			if score := rendezvousScore(ip, up.host); best == nil || score > bestScore {
+				best, bestScore = up, score
+			}
+		}
+		return []*upstream{best}
+	default:
+		if route.weighted {
+			return []*upstream{smoothWeighted(route, candidates)}
+		}
+		// Pick a single host round-robin.
+		i := (route.next.Add(1) - 1) % n
+		return []*upstream{candidates[i]}
+	}
+}
+
+// smoothWeighted picks one of candidates by smooth weighted round-robin, which
+// interleaves hosts in proportion to their weights instead of sending bursts.
+func smoothWeighted(route *BackendRoute, candidates []*upstream) *upstream {
+	route.wrrMu.Lock()
+	defer route.wrrMu.Unlock()
+	var best *upstream
+	total := 0
+	for _, up := range candidates {
+		up.currentWeight += up.weight
+		total += up.weight
+		if best == nil || up.currentWeight > best.currentWeight {
+			best = up
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// rendezvousScore returns the rendezvous hashing weight of host for key. It depends
+// only on its inputs, so the mapping is stable across restarts.
+func rendezvousScore(key, host string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(host))
+	return h.Sum64()
+}
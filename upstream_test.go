@@ -0,0 +1,76 @@
+package wsheartbeat
+
+import (
+	"context"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net/http/httptest"
+	"testing"
+)
+
+// ipHashProxy provisions a handler balancing over hosts by client IP.
+func ipHashProxy(t *testing.T, hosts ...string) *WSHeartbeat {
+	t.Helper()
+	m := &WSHeartbeat{LBPolicy: "ip_hash", BackendHost: hosts, BackendPaths: []string{"/ws"}}
+	provisionTest(t, m)
+	return m
+}
+
+// pickHost returns the upstream host m picks for an upgrade from the client ip.
+func pickHost(t *testing.T, m *WSHeartbeat, ip string) string {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/ws", nil)
+	vars := map[string]any{caddyhttp.ClientIPVarKey: ip}
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, vars))
+	route := m.routes[0]
+	picked := m.selectUpstreams(route, route.upstreams, r)
+	if len(picked) != 1 {
+		t.Fatalf("ip_hash picked %d upstreams, want 1", len(picked))
+	}
+	return picked[0].host
+}
+
+var ipHashHosts = []string{"10.0.0.1:9000", "10.0.0.2:9000", "10.0.0.3:9000"}
+
+func TestIPHashStableAcrossRestarts(t *testing.T) {
+	// The mapping only depends on the client IP and the host list, so it must match
+	// the one of any earlier process.
+	golden := []struct{ ip, host string }{
+		{"192.0.2.1", "10.0.0.1:9000"},
+		{"192.0.2.2", "10.0.0.3:9000"},
+		{"192.0.2.3", "10.0.0.3:9000"},
+		{"198.51.100.7", "10.0.0.3:9000"},
+		{"2001:db8::1", "10.0.0.2:9000"},
+		{"203.0.113.50", "10.0.0.3:9000"},
+	}
+	first := ipHashProxy(t, ipHashHosts...)
+	// Reprovisioning, also with the hosts in another order, changes nothing.
+	second := ipHashProxy(t, ipHashHosts[2], ipHashHosts[0], ipHashHosts[1])
+	for _, g := range golden {
+		if got := pickHost(t, first, g.ip); got != g.host {
+			t.Errorf("%s picked %s, want %s", g.ip, got, g.host)
+		}
+		if got := pickHost(t, second, g.ip); got != g.host {
+			t.Errorf("%s picked %s after reprovisioning, want %s", g.ip, got, g.host)
+		}
+	}
+}
+
+func TestIPHashRemovingHostOnlyRemapsItsClients(t *testing.T) {
+	all := ipHashProxy(t, ipHashHosts...)
+	fewer := ipHashProxy(t, ipHashHosts[0], ipHashHosts[1])
+	moved := 0
+	for i := range 256 {
+		ip := fmt.Sprintf("192.0.2.%d", i)
+		before, after := pickHost(t, all, ip), pickHost(t, fewer, ip)
+		switch {
+		case before == ipHashHosts[2]:
+			moved++
+		case after != before:
+			t.Errorf("%s moved from %s to %s, though its host wasn't removed", ip, before, after)
+		}
+	}
+	if moved == 0 {
+		t.Fatal("no client was on the removed host")
+	}
+}
@@ -0,0 +1,112 @@
+package wsheartbeat
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"time"
+)
+
+// errSessionDone is returned by the writes queued after the session was torn down.
+var errSessionDone = errors.New("websocket session done")
+
+// writeTimeoutError is returned by a control frame write that couldn't reach the
+// writer before its deadline. Like a net.Error, it is a timeout.
+type writeTimeoutError struct{}
+
+func (writeTimeoutError) Error() string   { return "websocket control frame write timed out" }
+func (writeTimeoutError) Timeout() bool   { return true }
+func (writeTimeoutError) Temporary() bool { return true }
+
+// frame is a write queued to the writer of a leg.
+type frame struct {
+	// msgType is the websocket message type.
+	msgType int
+	// data is the payload.
+	data []byte
+	// deadline bounds the write of a control frame.
+	deadline time.Time
+	// result receives the outcome of the write. It is buffered, so the writer never
+	// waits for a caller that gave up.
+	result chan error
+}
+
+// startWriter starts the only goroutine writing to the leg's connection, until done
+// is closed: gorilla/websocket allows a single concurrent writer. Data messages, and
+// control frames from the heartbeats, relays and closes, are all queued to it.
+func (l *leg) startWriter(done <-chan struct{}) {
+	l.done = done
+	l.frames, l.controls = make(chan frame), make(chan frame)
+	go func() {
+		for {
+			// Control frames go first, so heartbeats aren't delayed behind data.
+			select {
+			case f := <-l.controls:
+				f.result <- l.conn.WriteControl(f.msgType, f.data, f.deadline)
+				continue
+			default:
+			}
+			select {
+			case f := <-l.controls:
+				f.result <- l.conn.WriteControl(f.msgType, f.data, f.deadline)
+			case f := <-l.frames:
+				f.result <- l.conn.WriteMessage(f.msgType, f.data)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// write sends a data message on the leg through its writer, and returns the outcome.
+func (l *leg) write(msgType int, data []byte) error {
+	f := frame{msgType: msgType, data: data, result: make(chan error, 1)}
+	select {
+	case l.frames <- f:
+	case <-l.done:
+		return errSessionDone
+	}
+	select {
+	case err := <-f.result:
+		return err
+	case <-l.done:
+		return errSessionDone
+	}
+}
+
+// writeControl sends a control frame on the leg through its writer, within deadline,
+// and returns the outcome.
+func (l *leg) writeControl(msgType int, data []byte, deadline time.Time) error {
+	f := frame{msgType: msgType, data: data, deadline: deadline, result: make(chan error, 1)}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case l.controls <- f:
+	case <-timer.C:
+		return writeTimeoutError{}
+	case <-l.done:
+		return errSessionDone
+	}
+	select {
+	case err := <-f.result:
+		return err
+	case <-l.done:
+		return errSessionDone
+	}
+}
+
+// closeLeg sends a close frame with code and reason on the leg, within writeTimeout,
+// then closes its connection. Reasons too long for a close frame are truncated.
+func (l *leg) closeLeg(code int, reason string, writeTimeout time.Duration) {
+	msg := websocket.FormatCloseMessage(code, truncateCloseReason(reason))
+	_ = l.writeControl(websocket.CloseMessage, msg, time.Now().Add(writeTimeout))
+	_ = l.conn.Close()
+}
+
+// handleClose sets the close handler of the leg, which answers a close frame from
+// the peer like gorilla/websocket's default, but through the writer.
+func (l *leg) handleClose(writeTimeout time.Duration) {
+	l.conn.SetCloseHandler(func(code int, text string) error {
+		_ = l.writeControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(writeTimeout))
+		return nil
+	})
+}
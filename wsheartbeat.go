@@ -1,14 +1,31 @@
 package wsheartbeat
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"io"
+	"maps"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,23 +33,461 @@ import (
 
 // WSHeartbeat holds configuration and state for the websocket heartbeat module.
 type WSHeartbeat struct {
-	// Interval between heartbeat pings as a string (e.g., "15s").
+	// Interval between heartbeat pings as a string (e.g., "15s"). "off" or "0" disables
+	// the pings while still proxying the connections.
 	Interval string `json:"interval,omitempty"`
 	// intervalDuration is the parsed duration of Interval.
 	intervalDuration time.Duration
+	// PingBackend also sends heartbeat pings to the backend connection, with the same
+	// pong tracking as the client. A backend that stops answering closes both legs.
+	PingBackend bool `json:"ping_backend,omitempty"`
+	// BackendInterval is the interval between backend pings as a string (e.g., "30s").
+	// It defaults to Interval.
+	BackendInterval string `json:"backend_interval,omitempty"`
+	// Client holds the client heartbeat settings. Its values take precedence over
+	// the flat Interval, PongTimeout and MaxMissedPongs, which remain a shorthand.
+	Client *HeartbeatConfig `json:"client,omitempty"`
+	// Backend holds the backend heartbeat settings and enables PingBackend. Unset
+	// values fall back to BackendInterval and to the client settings.
+	Backend *HeartbeatConfig `json:"backend,omitempty"`
+	// Paths override the client heartbeat settings on specific request paths.
+	Paths []*PathHeartbeat `json:"paths,omitempty"`
+	// clientHeartbeat and backendHeartbeat are the parsed ping settings of each leg.
+	clientHeartbeat, backendHeartbeat heartbeat
+	// TextHeartbeat additionally sends an application-level text message every
+	// interval, optionally expecting a reply.
+	TextHeartbeat *TextHeartbeat `json:"text_heartbeat,omitempty"`
+	// Protocol selects an application heartbeat protocol spoken with the client:
+	// "graphql-ws" sends the keep-alive of the graphql-transport-ws subprotocol
+	// ({"type":"ping"}, answered by a pong) or, when the legacy graphql-ws
+	// subprotocol was negotiated, its {"type":"ka"}. "auto" infers the protocol from
+	// the negotiated subprotocol. "engineio" treats proxied Engine.IO ping ("2") and
+	// pong ("3") packets as proof of liveness, resetting the pong timers. "sockjs"
+	// sends the SockJS "h" heartbeat frame when the backend hasn't sent one within
+	// the interval and counts client traffic as proof of liveness.
+	Protocol string `json:"protocol,omitempty"`
+	// SuppressPings stops sending protocol pings when the heartbeat protocol carries
+	// its own, still applying the pong timeouts to the protocol's heartbeat.
+	SuppressPings bool `json:"suppress_pings,omitempty"`
+	// HeartbeatProtocolRaw is a guest module in the http.handlers.ws_heartbeat.protocols
+	// namespace whose probes replace the pings sent to clients. The default is the
+	// built-in "ping" protocol.
+	HeartbeatProtocolRaw json.RawMessage `json:"heartbeat_protocol,omitempty" caddy:"namespace=http.handlers.ws_heartbeat.protocols inline_key=name"`
+	// heartbeatProtocol is the provisioned HeartbeatProtocolRaw module, or nil for the
+	// built-in pings.
+	heartbeatProtocol HeartbeatProtocol
+	// RespondToTextPing answers text pings (such as "ping") with a text response
+	// (such as "pong") on the connection they came from, without proxying them.
+	RespondToTextPing *TextPingResponder `json:"respond_to_text_ping,omitempty"`
+	// Jitter randomly shifts the ping schedule of each connection by up to this much,
+	// as a duration (e.g., "2s") or a percentage of the interval (e.g., "10%"), so
+	// that connections opened together aren't all pinged on the same tick.
+	Jitter string `json:"jitter,omitempty"`
+	// JitterPerInterval applies a new random offset to every interval instead of
+	// only to the first one.
+	JitterPerInterval bool `json:"jitter_per_interval,omitempty"`
+	// Adaptive lets the ping interval of each connection tighten when its pongs are
+	// missed or slow and relax while they are timely, starting from Interval.
+	Adaptive *AdaptiveConfig `json:"adaptive,omitempty"`
+	// IdleOnly sends pings only after Interval without any message proxied in either
+	// direction, sparing the traffic on connections that are busy anyway.
+	IdleOnly bool `json:"idle_only,omitempty"`
+	// InitialDelay is the wait before the first ping as a string (e.g., "30s"),
+	// independent of Interval. Zero or unset waits one interval.
+	InitialDelay string `json:"initial_delay,omitempty"`
+	// PingWriteTimeout bounds the write of each ping, and of the other control frames
+	// the module sends, as a string (e.g., "5s").
+	PingWriteTimeout string `json:"ping_write_timeout,omitempty"`
+	// pingWriteTimeoutDuration is the parsed duration of PingWriteTimeout.
+	pingWriteTimeoutDuration time.Duration
+	// MaxMessageSize is the largest message read from either side, in bytes or with a
+	// unit (e.g., "1MiB"; default 32MiB). "0" means no limit. A side sending a larger
+	// message is closed with 1009 (message too big), and the other side normally.
+	MaxMessageSize string `json:"max_message_size,omitempty"`
+	// MaxClientMessageSize and MaxBackendMessageSize override MaxMessageSize for the
+	// messages read from the client and from the backend.
+	MaxClientMessageSize  string `json:"max_client_message_size,omitempty"`
+	MaxBackendMessageSize string `json:"max_backend_message_size,omitempty"`
+	// clientReadLimit and backendReadLimit are the parsed message size limits of each
+	// side, zero meaning none.
+	clientReadLimit  int64
+	backendReadLimit int64
+	// AllowedMessageTypes restricts the data messages proxied in both directions to
+	// "text", "binary" or "both" (default). Messages answered or consumed by the
+	// module itself, such as heartbeats, aren't affected.
+	AllowedMessageTypes string `json:"allowed_message_types,omitempty"`
+	// OnViolation is what happens to a message of a type that isn't allowed: "close"
+	// (default) closes its sender with 1003 (unsupported data), and the other side
+	// normally, and "drop" discards it. Violations are counted in the close log.
+	OnViolation string `json:"on_violation,omitempty"`
+	// allowedMessageType is the only message type proxied, or zero for both.
+	allowedMessageType int
+	// ReadDeadlineGrace enables dead peer detection through read deadlines: a
+	// pinged connection whose pong doesn't arrive within the interval, or the adaptive
+	// max interval, and jitter plus this grace as a string (e.g., "10s") fails its
+	// reads, closing both connections.
+	// The grace should cover the round-trip time. In idle_only mode, with suppressed
+	// pings or with a heartbeat protocol, any message read also pushes the deadline out.
+	ReadDeadlineGrace string `json:"read_deadline_grace,omitempty"`
+	// readDeadlineGraceDuration is the parsed duration of ReadDeadlineGrace.
+	readDeadlineGraceDuration time.Duration
+	// RefreshDeadlineOnRead also pushes the read deadline out on every message read,
+	// not only on pongs.
+	RefreshDeadlineOnRead bool `json:"refresh_deadline_on_read,omitempty"`
+	// KeepaliveFrame is the control frame sent each interval: "ping" (default) or
+	// "pong". Unsolicited pongs keep connections open for peers that can't cope with
+	// pings; as they get no reply, any message read from the peer then proves it alive.
+	KeepaliveFrame string `json:"keepalive_frame,omitempty"`
+	// keepaliveFrameType is the websocket message type of KeepaliveFrame.
+	keepaliveFrameType int
+	// HeartbeatCloseCode is the status code of the close frame sent to both sides when
+	// a connection is closed for a failed heartbeat (default 1001), so clients can
+	// tell it apart from a server shutdown.
+	HeartbeatCloseCode int `json:"heartbeat_close_code,omitempty"`
+	// HeartbeatCloseReason is the reason of that close frame, at most 123 bytes. By
+	// default it describes the failure.
+	HeartbeatCloseReason string `json:"heartbeat_close_reason,omitempty"`
+	// ForwardPings relays the pings sent by clients to the backend, and the backend's
+	// pongs back to the client, instead of answering them at the proxy. The backend
+	// then sees the client's liveness on its own.
+	ForwardPings bool `json:"forward_pings,omitempty"`
+	// BackendPing is how pings sent by the backend are handled: "local" (default)
+	// answers them at the proxy, "relay" forwards them to the client and returns the
+	// client's pong, so the backend sees a vanished client as dead.
+	BackendPing string `json:"backend_ping,omitempty"`
+	// BackendPingTimeout is how long a relayed backend ping waits for the client's
+	// pong as a string (default "10s"). Later pongs aren't returned to the backend.
+	BackendPingTimeout string `json:"backend_ping_timeout,omitempty"`
+	// backendPingTimeoutDuration is the parsed duration of BackendPingTimeout.
+	backendPingTimeoutDuration time.Duration
+	// PingPayload is the application data sent with each ping, at most 125 bytes.
+	// Placeholders such as {time.now.unix} are replaced per ping. By default the
+	// payload carries a timestamp used to measure the round-trip time.
+	PingPayload string `json:"ping_payload,omitempty"`
+	// PongTimeout is how long to wait for a pong after a ping as a string (e.g., "10s").
+	// When it elapses, both the client and backend connections are closed with 1001.
+	PongTimeout string `json:"pong_timeout,omitempty"`
+	// MaxMissedPongs is the number of consecutive pings left unanswered before the
+	// connection is closed (default 1). Any pong resets the count. Without PongTimeout,
+	// a ping counts as missed when no pong arrives within the interval.
+	MaxMissedPongs int `json:"max_missed_pongs,omitempty"`
+
+	// DialTimeout bounds the backend dial and handshake as a string (e.g., "10s").
+	DialTimeout string `json:"dial_timeout,omitempty"`
+	// dialTimeoutDuration is the parsed duration of DialTimeout.
+	dialTimeoutDuration time.Duration
+
+	// DialRetries is the number of times a failed backend dial is retried before giving up.
+	DialRetries int `json:"dial_retries,omitempty"`
+	// DialRetryInterval is the initial wait between dial retries as a string (e.g., "250ms").
+	// It doubles after each failed attempt.
+	DialRetryInterval string `json:"dial_retry_interval,omitempty"`
+	// dialRetryIntervalDuration is the parsed duration of DialRetryInterval.
+	dialRetryIntervalDuration time.Duration
 
 	// BackendHost is the host of the backend websocket server.
-	BackendHost string `json:"backend_host,omitempty"`
+	// It is either a bare host[:port] dialed over plain ws, or a "ws://" or "wss://" URL
+	// whose optional path is prefixed to the request path.
+	// A "unix/" prefix dials a unix domain socket, e.g. "unix//run/app/ws.sock", and a
+	// "srv+" prefix resolves the host as a DNS SRV record, e.g. "srv+_ws._tcp.app.internal".
+	// Placeholders such as {http.request.host} are replaced per request.
+	// Several hosts may be given; new connections are spread across them round-robin.
+	BackendHost HostList `json:"backend_host,omitempty"`
 	// BackendPaths is a list of allowed backend paths for websocket upgrade.
+	// Placeholders are replaced per request. When empty, every upgrade reaching the
+	// handler is proxied, leaving the path matching to Caddy's route matchers.
 	BackendPaths []string `json:"backend_paths,omitempty"`
+	// BackendPathsFile is a file of further backend paths for BackendHost, one per
+	// line, with "#" starting a comment. Malformed lines are logged and skipped.
+	BackendPathsFile string `json:"backend_paths_file,omitempty"`
+	// ReloadInterval is how often BackendPathsFile is re-read as a string, so that
+	// its changes apply without a config reload (default: never).
+	ReloadInterval string `json:"reload_interval,omitempty"`
+	// reloadIntervalDuration is the parsed ReloadInterval.
+	reloadIntervalDuration time.Duration
+	// reloadCancel stops the reloading of BackendPathsFile.
+	reloadCancel context.CancelFunc
+	// BackendWeights optionally gives the weight of each BackendHost entry, in order.
+	// With the round_robin policy, new connections are spread in proportion to the
+	// weights; a weight of 0 drains the host without treating it as an error.
+	BackendWeights []int `json:"backend_weights,omitempty"`
+	// LBPolicy selects how a backend host is picked among several:
+	// "round_robin" (default), "first", which tries the hosts in order
+	// and uses the first that completes the handshake, or "least_conn",
+	// which picks the host with the fewest active proxied connections, or
+	// "ip_hash", which consistently maps each client IP to the same host.
+	LBPolicy string `json:"lb_policy,omitempty"`
+	// HealthInterval enables active health checks of the backend hosts at this
+	// interval as a string (e.g., "10s"). Hosts failing a check are skipped by
+	// the load balancer until they pass again.
+	HealthInterval string `json:"health_interval,omitempty"`
+	// healthIntervalDuration is the parsed duration of HealthInterval.
+	healthIntervalDuration time.Duration
+	// HealthPath is the path, with an optional query, used for the health check
+	// handshake (default "/").
+	HealthPath string `json:"health_path,omitempty"`
+	// healthURL is the parsed HealthPath.
+	healthURL *url.URL
+	// healthCancel stops the health checker.
+	healthCancel context.CancelFunc
+	// FailDuration enables the per-host circuit breaker: after MaxFails consecutive
+	// dial failures a host is taken out of rotation for this long as a string
+	// (e.g., "30s"), then a single probe dial decides whether it comes back.
+	FailDuration string `json:"fail_duration,omitempty"`
+	// failDurationValue is the parsed duration of FailDuration.
+	failDurationValue time.Duration
+	// MaxFails is the number of consecutive dial failures that open the circuit
+	// breaker (default 3).
+	MaxFails int `json:"max_fails,omitempty"`
+	// CloseOnUnhealthy closes the connections proxied to a backend host once it is
+	// marked down by the health checks or its circuit breaker, after UnhealthyGrace,
+	// rather than waiting for the backend connections to fail.
+	CloseOnUnhealthy bool `json:"close_on_unhealthy,omitempty"`
+	// UnhealthyGrace is how long a host must stay down before its connections are
+	// closed, as a string (default "5s"), to ride out blips.
+	UnhealthyGrace string `json:"unhealthy_grace,omitempty"`
+	// unhealthyGraceDuration is the parsed duration of UnhealthyGrace.
+	unhealthyGraceDuration time.Duration
+	// UnhealthyCloseCode is the status code of the close frame sent to the clients of
+	// a host marked down (default 1013, try again later).
+	UnhealthyCloseCode int `json:"unhealthy_close_code,omitempty"`
+	// MaxConnsPerUpstream caps the proxied connections of each backend host. Hosts at
+	// the cap are skipped by the load balancer; when all are, upgrades get a 503.
+	MaxConnsPerUpstream int `json:"max_conns_per_upstream,omitempty"`
+	// MaxConnections caps the connections proxied by the handler. Upgrades over the
+	// cap get a 429 Too Many Requests. Zero means no limit.
+	MaxConnections int `json:"max_connections,omitempty"`
+	// MaxConnectionsPerIP caps the connections proxied by the handler for each client
+	// IP, resolved behind the server's trusted proxies. Upgrades over the cap get a
+	// 429 Too Many Requests. Zero means no limit.
+	MaxConnectionsPerIP int `json:"max_connections_per_ip,omitempty"`
+	// RetryAfter is sent as the Retry-After header, in seconds or as a duration string
+	// (e.g., "30s"), when no backend can be reached and the upgrade is answered with 503.
+	RetryAfter string `json:"retry_after,omitempty"`
+	// retryAfter is the Retry-After header value in seconds.
+	retryAfter string
+	// UpstreamsRaw is a dynamic upstream source module (such as "a" or "srv" from the
+	// http.reverse_proxy.upstreams namespace) consulted per connection for the backend
+	// hosts of BackendPaths. BackendHost, if given, is used when it reports none.
+	UpstreamsRaw json.RawMessage `json:"upstreams,omitempty" caddy:"namespace=http.reverse_proxy.upstreams inline_key=source"`
+	// upstreamSource is the provisioned UpstreamsRaw module.
+	upstreamSource reverseproxy.UpstreamSource
+	// UpstreamsScheme is the websocket scheme ("ws" or "wss") used to dial the
+	// addresses reported by the dynamic upstream source (default "ws").
+	UpstreamsScheme string `json:"upstreams_scheme,omitempty"`
+	// dynamicMu protects the dynamicPool map.
+	dynamicMu sync.Mutex
+	// dynamicPool holds the state of dynamic upstreams keyed by host.
+	dynamicPool map[string]*upstream
+	// Origins are the allowed Origin headers of upgrades: origins such as
+	// "https://app.example.com", hosts matching any scheme and port, with "*."
+	// matching a single label (e.g., "*.example.com"), "same_origin" for the request
+	// host, or "any" for every origin. Other origins are rejected with 403 before the
+	// backend is dialed. Upgrades without an Origin header are allowed. Defaults to
+	// same_origin, so cross-origin upgrades, allowed before origins were checked,
+	// need their origins listed or "any".
+	Origins []string `json:"origins,omitempty"`
+	// RequireOrigin rejects upgrades without an Origin header with 403, as only
+	// non-browser clients omit it.
+	RequireOrigin bool `json:"require_origin,omitempty"`
+	// RequireHeaders are headers that upgrades must all carry, such as one injected
+	// by a CDN, or else get 403 before the backend is dialed.
+	RequireHeaders []RequiredHeader `json:"require_headers,omitempty"`
+	// Metrics counts the rejected upgrades by reason in Caddy's metrics, as
+	// caddy_ws_heartbeat_upgrades_rejected_total. Every rejection is also logged as a
+	// "websocket upgrade denied" warning.
+	Metrics bool `json:"metrics,omitempty"`
+	// rejections is the counter of rejected upgrades, if Metrics.
+	rejections *prometheus.CounterVec
+	// RequireTLS rejects upgrades whose client connection isn't TLS with 403, before
+	// the backend is dialed. The X-Forwarded-Proto of a trusted proxy is believed.
+	RequireTLS bool `json:"require_tls,omitempty"`
+	// RedirectToTLS redirects the plaintext upgrades rejected by RequireTLS to https
+	// instead, with 308 Permanent Redirect.
+	RedirectToTLS bool `json:"redirect_to_tls,omitempty"`
+	// OriginOverride replaces the Origin header sent to the backend, after the
+	// client's origin was checked against Origins. Placeholders are replaced per
+	// request, and "none" removes the header.
+	OriginOverride string `json:"origin_override,omitempty"`
+	// originRules holds the parsed Origins entries other than same_origin and any.
+	originRules []originRule
+	// anyOrigin and sameOrigin report whether Origins has any or same_origin.
+	anyOrigin, sameOrigin bool
+	// Compression is how permessage-deflate is handled: "terminate" negotiates it with
+	// the client and the backend independently, decompressing and recompressing the
+	// messages in between, and "off" (default) disables it. Passing the extension
+	// through isn't possible, as messages are proxied one by one.
+	Compression string `json:"compression,omitempty"`
+	// DefaultSubprotocol is offered to the backend when the client offers none. The
+	// client's upgrade doesn't echo it, as the client didn't ask for a subprotocol.
+	DefaultSubprotocol string `json:"default_subprotocol,omitempty"`
+	// SubprotocolMismatch is what happens when the backend selects a subprotocol the
+	// client didn't offer: "close" closes both connections with 1002 (protocol error)
+	// (default), "ignore" proxies the connection without telling the client, and
+	// "prefer_backend" passes the backend's selection on to the client.
+	SubprotocolMismatch string `json:"subprotocol_mismatch,omitempty"`
+	// AllowedSubprotocols, if set, are the only subprotocols offered to the backend.
+	// Upgrades offering none of them are rejected with 400 before the backend is
+	// dialed; upgrades offering none at all still pass unless RequireSubprotocol.
+	AllowedSubprotocols []string `json:"allowed_subprotocols,omitempty"`
+	// DeniedSubprotocols rejects the upgrades offering any of these subprotocols with
+	// 403, before the backend is dialed, even when AllowedSubprotocols has them.
+	DeniedSubprotocols []string `json:"denied_subprotocols,omitempty"`
+	// RequireSubprotocol rejects upgrades offering no subprotocol with 400.
+	RequireSubprotocol bool `json:"require_subprotocol,omitempty"`
+	// ProtocolRoutes maps subprotocols to backend hosts. An upgrade allowed by the
+	// paths is proxied to the hosts of the first subprotocol offered by the client
+	// that has an entry, and to the hosts of its route otherwise. The subprotocol is
+	// still negotiated with the chosen backend.
+	ProtocolRoutes map[string]HostList `json:"protocol_routes,omitempty"`
+	// HostRoutes maps request host patterns to backend hosts, with "*." matching a
+	// single leading label (e.g., "*.example.com"). A matching upgrade is proxied to
+	// the hosts of its pattern whatever its path, and exact patterns win over wildcards.
+	HostRoutes map[string]HostList `json:"host_routes,omitempty"`
+	// UnmatchedHost is what happens to upgrades whose host matches none of HostRoutes:
+	// "default" proxies them by their path as usual (default), and "next" passes them
+	// to the next handler.
+	UnmatchedHost string `json:"unmatched_host,omitempty"`
+	// Routes are additional backends, each serving its own paths. Routes are matched
+	// in order after BackendHost and BackendPaths; the first matching route wins.
+	Routes []*BackendRoute `json:"routes,omitempty"`
+	// routes holds BackendHost and BackendPaths as the first route, followed by Routes
+	// and the routes of HostRoutes and ProtocolRoutes.
+	routes []*BackendRoute
+
+	// InsecureSkipVerify disables TLS certificate verification for wss backends.
+	// It must not be used in production.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+	// TrustedCACerts is a list of PEM file paths or inline PEM blocks of CA certificates
+	// trusted when verifying a wss backend, in place of the system roots.
+	TrustedCACerts []string `json:"trusted_ca_certs,omitempty"`
+	// ClientCertificateFile is the PEM certificate presented to wss backends requiring mutual TLS.
+	ClientCertificateFile string `json:"client_certificate_file,omitempty"`
+	// ClientCertificateKeyFile is the PEM private key matching ClientCertificateFile.
+	ClientCertificateKeyFile string `json:"client_certificate_key_file,omitempty"`
+	// TLSServerName overrides the server name used for SNI and certificate verification
+	// of wss backends, e.g. when the backend is dialed by IP.
+	TLSServerName string `json:"tls_server_name,omitempty"`
+	// tlsConfig is the TLS client configuration used when dialing a wss backend.
+	tlsConfig *tls.Config
+
+	// ExcludePaths are request paths never proxied, even when allowed by the backend
+	// paths, and passed to the next handler instead. They take the same forms as
+	// BackendPaths, and a path ending in "*" excludes a prefix (e.g., "/ws/internal/*").
+	ExcludePaths []string `json:"exclude_paths,omitempty"`
+	// excludeRegexps holds the compiled regular expression of each ExcludePaths entry
+	// starting with "~", and nil for the others.
+	excludeRegexps []*regexp.Regexp
+	// MatchQuery requires query parameters of the upgrade request: each key must have
+	// the given value, or be present at all for "*". Upgrades must match both the
+	// paths and the query to be proxied; others are passed to the next handler.
+	MatchQuery map[string]string `json:"match_query,omitempty"`
+	// NonWebSocket is what happens to requests that aren't websocket upgrades: "pass"
+	// hands them to the next handler (default), and "respond" answers those matching
+	// a route with 426 Upgrade Required instead.
+	NonWebSocket string `json:"non_websocket,omitempty"`
+	// Preflight, if set, answers OPTIONS requests matching a route itself, with
+	// Access-Control-Allow-* headers, instead of passing them to the next handler.
+	Preflight *Preflight `json:"preflight,omitempty"`
+	// MatchOptions loosen the comparison of request paths with the backend paths. The
+	// normalized path is forwarded.
+	MatchOptions *MatchOptions `json:"match_options,omitempty"`
+	// StripPrefix is removed from the start of the request path before it is forwarded
+	// to the backend, when it is made of whole path segments. Path matching still uses
+	// the original path.
+	StripPrefix string `json:"strip_prefix,omitempty"`
+	// ReplacePrefix replaces StripPrefix in the forwarded path when set. Placeholders,
+	// such as the groups of a regular expression backend path, are replaced per request.
+	ReplacePrefix string `json:"replace_prefix,omitempty"`
+
+	// HostHeader overrides the Host header sent in the backend handshake. The special
+	// value "preserve" passes through the client's original Host. Placeholders are
+	// replaced per request.
+	HostHeader string `json:"host_header,omitempty"`
+	// PreserveHost sends the client's original Host in the backend handshake instead
+	// of the backend address. It is equivalent to HostHeader "preserve".
+	PreserveHost bool `json:"preserve_host,omitempty"`
+	// ClientCertFields are the fields of the client's TLS certificate forwarded to the
+	// backend, when it presented one: "cn" (X-Client-Cert-CN), "serial"
+	// (X-Client-Cert-Serial) and "pem" (X-Client-Cert, URL-encoded), or "none"
+	// (default: cn and serial). Those headers are never taken from the client.
+	ClientCertFields []string `json:"client_cert_fields,omitempty"`
+	// RequestIDHeader is the header carrying the ID of each upgrade (default
+	// X-Request-Id). The client's value is reused when present, and a UUID generated
+	// otherwise. The ID is sent to the backend in the same header, set as the
+	// {ws.request_id} placeholder, and logged with every line of the connection.
+	RequestIDHeader string `json:"request_id_header,omitempty"`
+	// RequestIDResponseHeader, if set, returns the request ID to the client in this
+	// header of the upgrade response.
+	RequestIDResponseHeader string `json:"request_id_response_header,omitempty"`
+	// Cookies is the policy for the client's Cookie header in the backend handshake:
+	// "pass" (default) forwards it, "strip_all" removes it, and "allow" only keeps the
+	// cookies named in AllowedCookies.
+	Cookies string `json:"cookies,omitempty"`
+	// AllowedCookies are the names of the cookies forwarded with Cookies "allow".
+	AllowedCookies []string `json:"allowed_cookies,omitempty"`
+	// TrustedProxies lists the networks (CIDRs, single IPs or "private_ranges") of the
+	// proxies in front of Caddy, such as a CDN. When the immediate peer is one of them,
+	// the client IP is the rightmost entry of X-Forwarded-For that isn't, and the
+	// forwarded headers it sent are kept. Without any, the server's trusted_proxies
+	// apply. The client IP keys the limits and ip_hash, and is logged.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+	// trustedProxies are the parsed TrustedProxies.
+	trustedProxies []netip.Prefix
+	// RateLimit, if set, limits the upgrade attempts of each client IP, resolved
+	// behind the server's trusted proxies. Attempts over the limit get a 429 Too Many
+	// Requests with a Retry-After header, before the backend is dialed.
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+	// RemoteIP, if set, rejects upgrades from client IPs it doesn't allow with 403
+	// Forbidden, before the backend is dialed. The client IP is the real one behind
+	// the server's trusted proxies.
+	RemoteIP *RemoteIPRules `json:"remote_ip,omitempty"`
+	// JWT, if set, rejects upgrades without a valid JSON web token with 401
+	// Unauthorized, before the backend is dialed.
+	JWT *JWTAuth `json:"jwt,omitempty"`
+	// Ticket, if set, rejects upgrades without a valid ticket signed by the
+	// application with 403 Forbidden, before the backend is dialed.
+	Ticket *Ticket `json:"ticket,omitempty"`
+	// BackendAuth sets the Authorization header of the backend handshake.
+	BackendAuth *BackendAuth `json:"backend_auth,omitempty"`
+	// HeaderUp changes the headers of the backend handshake, in order, after the
+	// client's websocket headers are removed and the forwarded headers are set.
+	HeaderUp []HeaderRule `json:"header_up,omitempty"`
+	// HeaderDown lists the headers of the backend's handshake response copied to the
+	// client's, or "*" for all of them. Hop-by-hop and websocket headers never are.
+	HeaderDown []string `json:"header_down,omitempty"`
+
+	// ForwardProxy is the URL of an HTTP CONNECT ("http://proxy:3128") or SOCKS5
+	// ("socks5://proxy:1080") proxy used to reach the backend. Credentials may be
+	// given in the URL user info.
+	ForwardProxy string `json:"forward_proxy,omitempty"`
+	// forwardProxyURL is the parsed ForwardProxy.
+	forwardProxyURL *url.URL
+	// SRVCacheTTL is how long SRV lookups of "srv+" backends are cached as a string (e.g., "1m").
+	SRVCacheTTL string `json:"srv_cache_ttl,omitempty"`
+	// srvCacheTTLDuration is the parsed duration of SRVCacheTTL.
+	srvCacheTTLDuration time.Duration
+	// srvMu protects the srvCache map.
+	srvMu sync.Mutex
+	// srvCache holds SRV lookup results keyed by record name.
+	srvCache map[string]srvEntry
+	// dialer is the template dialer used to connect to the backend.
+	dialer websocket.Dialer
+
+	// limitsMu protects limits.
+	limitsMu sync.Mutex
+	// limits counts the connections for MaxConnections and MaxConnectionsPerIP.
+	limits connLimits
 
 	// mu protects the connections map.
 	mu sync.Mutex
-	// connections tracks active client websocket connections.
-	connections map[*websocket.Conn]struct{}
+	// connections tracks active client websocket connections and their sessions.
+	connections map[*websocket.Conn]*session
 
 	// logger is used for logging module events.
 	logger *zap.Logger
+	// timers, if set, makes the timers of the ping loops instead of the system clock.
+	timers func(d time.Duration) timer
 }
 
 func init() {
@@ -40,6 +495,8 @@ func init() {
 	caddy.RegisterModule(&WSHeartbeat{})
 	// Register the directive "ws_heartbeat" for the HTTP Caddyfile.
 	httpcaddyfile.RegisterHandlerDirective("ws_heartbeat", parseCaddyfile)
+	// Order it before reverse_proxy by default, which a global order option overrides.
+	httpcaddyfile.RegisterDirectiveOrder("ws_heartbeat", httpcaddyfile.Before, "reverse_proxy")
 }
 
 // CaddyModule returns the Caddy module information.
@@ -55,68 +512,760 @@ func (m *WSHeartbeat) CaddyModule() caddy.ModuleInfo {
 // Provision sets up the module, parsing durations and ensuring required configuration is provided.
 func (m *WSHeartbeat) Provision(ctx caddy.Context) error {
 	m.logger = ctx.Logger(m)
+	// Initialize the connections map before the background goroutines can look at it.
+	m.connections = make(map[*websocket.Conn]*session)
+	// Expand {env.*} placeholders up front so validation errors mention the expanded values.
+	expandEnvFields(reflect.ValueOf(m))
 	// Set default interval if not provided.
 	if m.Interval == "" {
 		m.Interval = "15s"
 	}
 	// Parse the interval duration.
-	dur, err := time.ParseDuration(m.Interval)
-	if err != nil || dur <= 0 {
+	dur, err := parseInterval(m.Interval)
+	if err != nil {
 		return fmt.Errorf("invalid interval: %s", m.Interval)
 	}
 	m.intervalDuration = dur
-	// Ensure backend host is specified.
-	if m.BackendHost == "" {
-		return fmt.Errorf("backend host (first value) must be specified")
+	// Set up the text heartbeat, if enabled.
+	if m.TextHeartbeat != nil {
+		if err := m.TextHeartbeat.provision(); err != nil {
+			return err
+		}
+	}
+	// Validate the heartbeat protocol.
+	switch m.Protocol {
+	case "", "auto", "graphql-ws", "engineio", "sockjs":
+	default:
+		return fmt.Errorf("unknown heartbeat protocol: %s", m.Protocol)
+	}
+	if m.SuppressPings && m.Protocol != "engineio" && m.Protocol != "sockjs" {
+		return fmt.Errorf("suppress_pings requires protocol engineio or sockjs")
+	}
+	if m.Protocol != "" && m.Protocol != "engineio" && m.TextHeartbeat != nil {
+		return fmt.Errorf("text_heartbeat cannot be combined with protocol %s", m.Protocol)
+	}
+	// Load the heartbeat protocol module, if configured.
+	m.heartbeatProtocol = nil
+	if m.HeartbeatProtocolRaw != nil {
+		mod, err := ctx.LoadModule(m, "HeartbeatProtocolRaw")
+		if err != nil {
+			return fmt.Errorf("loading heartbeat protocol module: %v", err)
+		}
+		if _, ok := mod.(*PingProtocol); !ok {
+			m.heartbeatProtocol = mod.(HeartbeatProtocol)
+		}
+	}
+	if m.heartbeatProtocol != nil && (m.Protocol != "" || m.TextHeartbeat != nil) {
+		return fmt.Errorf("heartbeat_protocol cannot be combined with protocol or text_heartbeat")
+	}
+	// Set up the local text ping responses, if enabled.
+	if m.RespondToTextPing != nil {
+		if err := m.RespondToTextPing.provision(); err != nil {
+			return err
+		}
+	}
+	// Control frames can't carry more than 125 bytes.
+	if n := len(placeholderRegexp.ReplaceAllString(m.PingPayload, "")); n > maxControlPayload {
+		return fmt.Errorf("ping payload too long: %d bytes, at most %d allowed", n, maxControlPayload)
+	}
+	// Parse the pong timeout, if enabled.
+	var pongTimeout time.Duration
+	if m.PongTimeout != "" {
+		pongTimeout, err = time.ParseDuration(m.PongTimeout)
+		if err != nil || pongTimeout <= 0 {
+			return fmt.Errorf("invalid pong timeout: %s", m.PongTimeout)
+		}
+	}
+	// Validate the missed pong threshold, which also enables pong tracking on its own.
+	if m.MaxMissedPongs < 0 {
+		return fmt.Errorf("invalid max missed pongs: %d", m.MaxMissedPongs)
+	}
+	m.clientHeartbeat = heartbeat{interval: m.intervalDuration, pongTimeout: pongTimeout, maxMissedPongs: m.MaxMissedPongs}
+	// Parse the control frame write timeout.
+	if m.PingWriteTimeout == "" {
+		m.PingWriteTimeout = "5s"
+	}
+	dur, err = time.ParseDuration(m.PingWriteTimeout)
+	if err != nil || dur <= 0 {
+		return fmt.Errorf("invalid ping write timeout: %s", m.PingWriteTimeout)
+	}
+	m.pingWriteTimeoutDuration = dur
+	// Validate the close frame sent for failed heartbeats.
+	if m.HeartbeatCloseCode == 0 {
+		m.HeartbeatCloseCode = websocket.CloseGoingAway
+	}
+	if !validCloseCode(m.HeartbeatCloseCode) {
+		return fmt.Errorf("invalid heartbeat close code: %d", m.HeartbeatCloseCode)
+	}
+	if n := len(m.HeartbeatCloseReason); n > maxControlPayload-2 {
+		return fmt.Errorf("heartbeat close reason too long: %d bytes, at most %d allowed", n, maxControlPayload-2)
+	}
+	// Validate the keepalive frame type.
+	switch m.KeepaliveFrame {
+	case "", "ping":
+		m.keepaliveFrameType = websocket.PingMessage
+	case "pong":
+		m.keepaliveFrameType = websocket.PongMessage
+	default:
+		return fmt.Errorf("invalid keepalive_frame: %s, must be ping or pong", m.KeepaliveFrame)
+	}
+	// Validate the backend ping handling and parse the relay timeout.
+	switch m.BackendPing {
+	case "", "local":
+		if m.BackendPingTimeout != "" {
+			return fmt.Errorf("backend_ping_timeout requires backend_ping relay")
+		}
+	case "relay":
+		if m.BackendPingTimeout == "" {
+			m.BackendPingTimeout = "10s"
+		}
+		dur, err = time.ParseDuration(m.BackendPingTimeout)
+		if err != nil || dur <= 0 {
+			return fmt.Errorf("invalid backend ping timeout: %s", m.BackendPingTimeout)
+		}
+		m.backendPingTimeoutDuration = dur
+	default:
+		return fmt.Errorf("invalid backend_ping: %s, must be local or relay", m.BackendPing)
+	}
+	// Bound the messages read from each side, generously by default.
+	maxMessageSize, err := parseMessageSize("max message size", m.MaxMessageSize, defaultMaxMessageSize)
+	if err != nil {
+		return err
+	}
+	if m.clientReadLimit, err = parseMessageSize("max client message size", m.MaxClientMessageSize, maxMessageSize); err != nil {
+		return err
+	}
+	if m.backendReadLimit, err = parseMessageSize("max backend message size", m.MaxBackendMessageSize, maxMessageSize); err != nil {
+		return err
+	}
+	switch m.AllowedMessageTypes {
+	case "", "both":
+		m.allowedMessageType = 0
+	case "text":
+		m.allowedMessageType = websocket.TextMessage
+	case "binary":
+		m.allowedMessageType = websocket.BinaryMessage
+	default:
+		return fmt.Errorf("allowed_message_types must be text, binary or both, got %s", m.AllowedMessageTypes)
+	}
+	switch m.OnViolation {
+	case "", "close", "drop":
+	default:
+		return fmt.Errorf("on_violation must be close or drop, got %s", m.OnViolation)
+	}
+	// Parse the read deadline grace, if enabled.
+	m.readDeadlineGraceDuration = 0
+	if m.ReadDeadlineGrace != "" {
+		dur, err = time.ParseDuration(m.ReadDeadlineGrace)
+		if err != nil || dur <= 0 {
+			return fmt.Errorf("invalid read deadline grace: %s", m.ReadDeadlineGrace)
+		}
+		m.readDeadlineGraceDuration = dur
+	} else if m.RefreshDeadlineOnRead {
+		return fmt.Errorf("refresh_deadline_on_read requires read_deadline_grace")
+	}
+	// Parse the delay before the first ping; zero keeps waiting one interval.
+	if m.InitialDelay != "" {
+		dur, err = time.ParseDuration(m.InitialDelay)
+		if err != nil || dur < 0 {
+			return fmt.Errorf("invalid initial delay: %s", m.InitialDelay)
+		}
+		m.clientHeartbeat.initialDelay = dur
+	}
+	// Apply the client section over the flat options.
+	if m.Client != nil {
+		m.clientHeartbeat, err = m.Client.provision("client", m.clientHeartbeat)
+		if err != nil {
+			return err
+		}
+	}
+	// Parse the backend ping interval, defaulting to the client's.
+	m.backendHeartbeat = m.clientHeartbeat
+	if m.BackendInterval != "" {
+		if !m.PingBackend && m.Backend == nil {
+			return fmt.Errorf("backend_interval requires ping_backend")
+		}
+		dur, err = parseInterval(m.BackendInterval)
+		if err != nil {
+			return fmt.Errorf("invalid backend interval: %s", m.BackendInterval)
+		}
+		m.backendHeartbeat.interval = dur
+	}
+	// A backend section turns on backend pings.
+	if m.Backend != nil {
+		m.PingBackend = true
+		m.backendHeartbeat, err = m.Backend.provision("backend", m.backendHeartbeat)
+		if err != nil {
+			return err
+		}
+	}
+	// Pongs can't be awaited without pings.
+	if err := m.clientHeartbeat.validate("client"); err != nil {
+		return err
+	}
+	if m.PingBackend {
+		if err := m.backendHeartbeat.validate("backend"); err != nil {
+			return err
+		}
+	}
+	// Spread the ping schedules by the jitter, relative to each side's interval.
+	m.clientHeartbeat, err = m.clientHeartbeat.withJitter(m.Jitter, m.JitterPerInterval)
+	if err != nil {
+		return err
+	}
+	m.backendHeartbeat, err = m.backendHeartbeat.withJitter(m.Jitter, m.JitterPerInterval)
+	if err != nil {
+		return err
+	}
+	// Bound the adaptive intervals, if enabled, relative to each side's interval.
+	m.clientHeartbeat, err = m.clientHeartbeat.withAdaptive(m.Adaptive)
+	if err != nil {
+		return err
+	}
+	m.backendHeartbeat, err = m.backendHeartbeat.withAdaptive(m.Adaptive)
+	if err != nil {
+		return err
+	}
+	// Resolve the per-path overrides over the client heartbeat.
+	seenPaths := make(map[string]bool)
+	for _, p := range m.Paths {
+		if p.Path == "" {
+			return fmt.Errorf("path heartbeat override without a path")
+		}
+		if seenPaths[p.Path] {
+			return fmt.Errorf("duplicate path heartbeat override: %s", p.Path)
+		}
+		seenPaths[p.Path] = true
+		name := "path " + p.Path
+		hb, err := p.provision(name, m.clientHeartbeat)
+		if err != nil {
+			return err
+		}
+		if err := hb.validate(name); err != nil {
+			return err
+		}
+		if hb, err = hb.withJitter(m.Jitter, m.JitterPerInterval); err != nil {
+			return err
+		}
+		if p.hb, err = hb.withAdaptive(m.Adaptive); err != nil {
+			return err
+		}
+	}
+	// Set default dial timeout if not provided.
+	if m.DialTimeout == "" {
+		m.DialTimeout = "10s"
+	}
+	// Parse the dial timeout duration.
+	dur, err = time.ParseDuration(m.DialTimeout)
+	if err != nil || dur <= 0 {
+		return fmt.Errorf("invalid dial timeout: %s", m.DialTimeout)
+	}
+	m.dialTimeoutDuration = dur
+	// Validate the dial retry settings.
+	if m.DialRetries < 0 {
+		return fmt.Errorf("invalid dial retries: %d", m.DialRetries)
+	}
+	if m.DialRetryInterval == "" {
+		m.DialRetryInterval = "250ms"
+	}
+	dur, err = time.ParseDuration(m.DialRetryInterval)
+	if err != nil || dur <= 0 {
+		return fmt.Errorf("invalid dial retry interval: %s", m.DialRetryInterval)
+	}
+	m.dialRetryIntervalDuration = dur
+	// Load the dynamic upstream source, if configured.
+	if m.UpstreamsRaw != nil {
+		mod, err := ctx.LoadModule(m, "UpstreamsRaw")
+		if err != nil {
+			return fmt.Errorf("loading upstream source module: %v", err)
+		}
+		m.upstreamSource = mod.(reverseproxy.UpstreamSource)
+		if m.UpstreamsScheme == "" {
+			m.UpstreamsScheme = "ws"
+		}
+		if m.UpstreamsScheme != "ws" && m.UpstreamsScheme != "wss" {
+			return fmt.Errorf("upstreams_scheme must be ws or wss, got %s", m.UpstreamsScheme)
+		}
+		m.dynamicPool = make(map[string]*upstream)
+	}
+	// Collect the routes, starting with the one given by BackendHost and BackendPaths.
+	m.routes = nil
+	// Host routes alone need no default backend.
+	if len(m.BackendHost) > 0 || len(m.BackendPaths) > 0 || m.BackendPathsFile != "" || (len(m.Routes) == 0 && len(m.HostRoutes) == 0) || m.upstreamSource != nil {
+		// Ensure backend host is specified.
+		if len(m.BackendHost) == 0 && m.upstreamSource == nil {
+			return fmt.Errorf("backend host (first value) must be specified")
+		}
+		m.routes = append(m.routes, &BackendRoute{
+			BackendHost:    m.BackendHost,
+			BackendPaths:   m.BackendPaths,
+			BackendWeights: m.BackendWeights,
+			dynamic:        m.upstreamSource != nil,
+		})
+	}
+	m.routes = append(m.routes, m.Routes...)
+	// Add the host routes, in a stable order.
+	for _, pattern := range slices.Sorted(maps.Keys(m.HostRoutes)) {
+		if !validHostPattern(pattern) {
+			return fmt.Errorf("invalid host route pattern: %s", pattern)
+		}
+		if len(m.HostRoutes[pattern]) == 0 {
+			return fmt.Errorf("host route %s: backend host must be specified", pattern)
+		}
+		m.routes = append(m.routes, &BackendRoute{BackendHost: m.HostRoutes[pattern], hostPattern: strings.ToLower(pattern)})
+	}
+	if m.RequestIDHeader == "" {
+		m.RequestIDHeader = "X-Request-Id"
+	}
+	if err := m.provisionOrigins(); err != nil {
+		return err
+	}
+	if m.BackendAuth != nil {
+		if err := m.BackendAuth.validate(); err != nil {
+			return err
+		}
+	}
+	if err := m.provisionMetrics(ctx); err != nil {
+		return fmt.Errorf("registering metrics: %v", err)
+	}
+	if err := m.provisionRequiredHeaders(); err != nil {
+		return err
+	}
+	if err := m.provisionTrustedProxies(); err != nil {
+		return fmt.Errorf("trusted_proxies: %v", err)
+	}
+	if m.RateLimit != nil {
+		if err := m.RateLimit.provision(); err != nil {
+			return err
+		}
+	}
+	if m.RemoteIP != nil {
+		if err := m.RemoteIP.provision(); err != nil {
+			return err
+		}
+	}
+	if m.JWT != nil {
+		if err := m.JWT.provision(); err != nil {
+			return err
+		}
+	}
+	if m.Ticket != nil {
+		if err := m.Ticket.provision(); err != nil {
+			return err
+		}
+	}
+	if err := validateClientCertFields(m.ClientCertFields); err != nil {
+		return err
+	}
+	if err := validateHeaderRules("header_up", m.HeaderUp); err != nil {
+		return err
+	}
+	switch m.SubprotocolMismatch {
+	case "", "close", "ignore", "prefer_backend":
+	default:
+		return fmt.Errorf("subprotocol_mismatch must be close, ignore or prefer_backend, got %s", m.SubprotocolMismatch)
+	}
+	switch m.NonWebSocket {
+	case "", "pass", "respond":
+	default:
+		return fmt.Errorf("non_websocket must be pass or respond, got %s", m.NonWebSocket)
+	}
+	switch m.Cookies {
+	case "", "pass", "strip_all":
+	case "allow":
+		if len(m.AllowedCookies) == 0 {
+			return fmt.Errorf("cookies allow requires cookie names")
+		}
+	default:
+		return fmt.Errorf("cookies must be pass, strip_all or allow, got %s", m.Cookies)
+	}
+	switch m.UnmatchedHost {
+	case "", "default", "next":
+	default:
+		return fmt.Errorf("unmatched_host must be default or next, got %s", m.UnmatchedHost)
+	}
+	// Add the subprotocol routes, in a stable order.
+	for _, name := range slices.Sorted(maps.Keys(m.ProtocolRoutes)) {
+		if len(m.ProtocolRoutes[name]) == 0 {
+			return fmt.Errorf("protocol route %s: backend host must be specified", name)
+		}
+		m.routes = append(m.routes, &BackendRoute{BackendHost: m.ProtocolRoutes[name], subprotocol: name})
+	}
+	// Validate the load balancing policy.
+	switch m.LBPolicy {
+	case "", "round_robin", "first", "least_conn", "ip_hash":
+	default:
+		return fmt.Errorf("unknown lb_policy: %s", m.LBPolicy)
 	}
-	// Ensure at least one backend path is provided.
-	if len(m.BackendPaths) == 0 {
-		return fmt.Errorf("backend paths (second value and onwards) must have at least one entry")
+	if err := m.provisionRoutes(); err != nil {
+		return err
+	}
+	// Load the paths file into the first route, which it extends.
+	if m.BackendPathsFile != "" {
+		data, err := m.loadPathsFile(m.routes[0])
+		if err != nil {
+			return err
+		}
+		if m.ReloadInterval != "" {
+			dur, err := time.ParseDuration(m.ReloadInterval)
+			if err != nil || dur <= 0 {
+				return fmt.Errorf("invalid reload interval: %s", m.ReloadInterval)
+			}
+			m.reloadIntervalDuration = dur
+			var reloadCtx context.Context
+			reloadCtx, m.reloadCancel = context.WithCancel(context.Background())
+			go m.reloadPathsFile(reloadCtx, m.routes[0], data)
+		}
+	} else if m.ReloadInterval != "" {
+		return fmt.Errorf("reload_interval requires backend_paths_file")
+	}
+	if err := m.provisionExcludes(); err != nil {
+		return err
+	}
+	// Parse the SRV cache TTL.
+	if m.SRVCacheTTL == "" {
+		m.SRVCacheTTL = "1m"
+	}
+	dur, err = time.ParseDuration(m.SRVCacheTTL)
+	if err != nil || dur < 0 {
+		return fmt.Errorf("invalid SRV cache TTL: %s", m.SRVCacheTTL)
+	}
+	m.srvCacheTTLDuration = dur
+	m.srvCache = make(map[string]srvEntry)
+	// Set up TLS for the backend connection.
+	if err := m.provisionTLS(); err != nil {
+		return err
+	}
+	// Validate the compression mode. Extensions can't be passed through, as messages
+	// are read and written again rather than forwarded frame by frame.
+	switch m.Compression {
+	case "", "off", "terminate":
+	case "passthrough":
+		return fmt.Errorf("compression passthrough is not possible when proxying per message, use terminate")
+	default:
+		return fmt.Errorf("compression must be terminate or off, got %s", m.Compression)
+	}
+	// Build the template dialer shared by all connections of this handler.
+	m.dialer = websocket.Dialer{
+		TLSClientConfig:  m.tlsConfig,
+		HandshakeTimeout: m.dialTimeoutDuration,
+		// Each leg negotiates permessage-deflate on its own when terminated.
+		EnableCompression: m.Compression == "terminate",
+	}
+	// A replacement only makes sense with a prefix to replace.
+	if m.ReplacePrefix != "" && m.StripPrefix == "" {
+		return fmt.Errorf("replace_prefix requires strip_prefix")
+	}
+	// preserve_host and an explicit host_header contradict each other.
+	if m.PreserveHost && m.HostHeader != "" && m.HostHeader != "preserve" {
+		return fmt.Errorf("preserve_host cannot be combined with host_header %s", m.HostHeader)
+	}
+	// Route backend dials through the forward proxy, if configured.
+	if m.ForwardProxy != "" {
+		if err := m.provisionForwardProxy(); err != nil {
+			return err
+		}
+	}
+	// Parse the circuit breaker settings.
+	if m.FailDuration != "" {
+		dur, err = time.ParseDuration(m.FailDuration)
+		if err != nil || dur <= 0 {
+			return fmt.Errorf("invalid fail duration: %s", m.FailDuration)
+		}
+		m.failDurationValue = dur
+		if m.MaxFails == 0 {
+			m.MaxFails = 3
+		}
+	}
+	if m.MaxFails < 0 {
+		return fmt.Errorf("invalid max fails: %d", m.MaxFails)
+	}
+	// Parse the closing of connections to hosts marked down, if enabled.
+	if m.CloseOnUnhealthy {
+		if m.HealthInterval == "" && m.FailDuration == "" {
+			return fmt.Errorf("close_on_unhealthy requires health_interval or fail_duration")
+		}
+		if m.UnhealthyGrace == "" {
+			m.UnhealthyGrace = "5s"
+		}
+		dur, err = time.ParseDuration(m.UnhealthyGrace)
+		if err != nil || dur < 0 {
+			return fmt.Errorf("invalid unhealthy grace: %s", m.UnhealthyGrace)
+		}
+		m.unhealthyGraceDuration = dur
+		if m.UnhealthyCloseCode == 0 {
+			m.UnhealthyCloseCode = websocket.CloseTryAgainLater
+		}
+		if !validCloseCode(m.UnhealthyCloseCode) {
+			return fmt.Errorf("invalid unhealthy close code: %d", m.UnhealthyCloseCode)
+		}
+	} else if m.UnhealthyGrace != "" || m.UnhealthyCloseCode != 0 {
+		return fmt.Errorf("unhealthy_grace and unhealthy_close_code require close_on_unhealthy")
+	}
+	if m.MaxConnsPerUpstream < 0 {
+		return fmt.Errorf("invalid max conns per upstream: %d", m.MaxConnsPerUpstream)
+	}
+	if m.MaxConnections < 0 {
+		return fmt.Errorf("invalid max connections: %d", m.MaxConnections)
+	}
+	if m.MaxConnectionsPerIP < 0 {
+		return fmt.Errorf("invalid max connections per ip: %d", m.MaxConnectionsPerIP)
+	}
+	// Normalize Retry-After to whole seconds.
+	m.retryAfter = ""
+	if m.RetryAfter != "" {
+		seconds, err := strconv.Atoi(m.RetryAfter)
+		if err != nil {
+			dur, err := time.ParseDuration(m.RetryAfter)
+			if err != nil {
+				return fmt.Errorf("invalid retry after: %s", m.RetryAfter)
+			}
+			seconds = int(dur.Round(time.Second) / time.Second)
+		}
+		if seconds < 0 {
+			return fmt.Errorf("invalid retry after: %s", m.RetryAfter)
+		}
+		m.retryAfter = strconv.Itoa(seconds)
+	}
+	// Start the active health checker, if enabled.
+	if m.HealthInterval != "" {
+		dur, err = time.ParseDuration(m.HealthInterval)
+		if err != nil || dur <= 0 {
+			return fmt.Errorf("invalid health interval: %s", m.HealthInterval)
+		}
+		m.healthIntervalDuration = dur
+		if m.HealthPath == "" {
+			m.HealthPath = "/"
+		}
+		m.healthURL, err = url.Parse(m.HealthPath)
+		if err != nil || !strings.HasPrefix(m.healthURL.Path, "/") {
+			return fmt.Errorf("invalid health path: %s", m.HealthPath)
+		}
+		var healthCtx context.Context
+		healthCtx, m.healthCancel = context.WithCancel(context.Background())
+		go m.runHealthChecks(healthCtx)
+	} else if m.HealthPath != "" {
+		return fmt.Errorf("health_path requires health_interval")
 	}
-	// Initialize the connections map.
-	m.connections = make(map[*websocket.Conn]struct{})
+	// Expose the upstreams on the admin API.
+	registerHandler(m)
 	m.logger.Debug("WSHeartbeat provisioned",
 		zap.String("interval", m.Interval),
-		zap.String("backend_host", m.BackendHost),
+		zap.String("dial_timeout", m.DialTimeout),
+		zap.Strings("backend_host", m.BackendHost),
 		zap.Strings("backend_paths", m.BackendPaths),
+		zap.Int("routes", len(m.routes)),
 	)
 	return nil
 }
 
+// Cleanup stops the background work of the module when its configuration is unloaded.
+func (m *WSHeartbeat) Cleanup() error {
+	unregisterHandler(m)
+	if m.healthCancel != nil {
+		m.healthCancel()
+	}
+	if m.reloadCancel != nil {
+		m.reloadCancel()
+	}
+	return nil
+}
+
 // ServeHTTP handles incoming HTTP requests and upgrades them to websocket connections if appropriate.
+// Errors are only returned before the upgrade hijacks the response; those ending a
+// proxied connection are logged.
 func (m *WSHeartbeat) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	// If the request is not a websocket upgrade, pass it on to the next handler.
-	if !websocket.IsWebSocketUpgrade(r) {
+	// If the request is not a websocket upgrade, pass it on to the next handler,
+	// unless it must be answered on the paths of the routes.
+	isUpgrade := websocket.IsWebSocketUpgrade(r)
+	isPreflight := !isUpgrade && r.Method == http.MethodOptions && m.Preflight != nil
+	if !isUpgrade && !isPreflight && m.NonWebSocket != "respond" {
 		return next.ServeHTTP(w, r)
 	}
 
-	// Check if the request URL path is allowed based on BackendPaths.
-	allowed := false
-	for _, p := range m.BackendPaths {
-		if p == r.URL.Path {
-			allowed = true
-			break
-		}
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	// Leave excluded paths, and requests without the required query, to the next
+	// handler, whatever the backend paths allow.
+	if m.excluded(r.URL.Path, repl) || !m.matchQuery(r.URL.Query()) {
+		return next.ServeHTTP(w, r)
+	}
+
+	// Find the route of the request host, or else the one whose paths allow the
+	// request URL path.
+	var route *BackendRoute
+	var matchedPath string
+	if hr := m.hostRoute(r.Host); hr != nil {
+		route, matchedPath = hr, m.matchOptions().trim(r.URL.Path)
+	} else if len(m.HostRoutes) == 0 || m.UnmatchedHost != "next" {
+		route, matchedPath = m.matchRoute(r.URL.Path, repl)
 	}
-	if !allowed {
+	if route == nil {
 		return next.ServeHTTP(w, r)
 	}
 
-	// Get and process the Sec-WebSocket-Protocol header from the client.
-	rawClientProtocols := r.Header.Get("Sec-WebSocket-Protocol")
-	var offeredByClient []string
-	if rawClientProtocols != "" {
-		parts := strings.Split(rawClientProtocols, ",")
-		for _, p := range parts {
-			p = strings.TrimSpace(p)
-			if p != "" {
-				offeredByClient = append(offeredByClient, p)
+	// Answer the OPTIONS requests sent by some clients before they upgrade.
+	if isPreflight {
+		return m.Preflight.respond(w, r, m, repl)
+	}
+	// Tell plain requests to the routes' paths that they must upgrade.
+	if !isUpgrade {
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusUpgradeRequired)
+		_, err := io.WriteString(w, "This endpoint requires a websocket upgrade.\n")
+		return err
+	}
+	// Tag the connection with its request ID, for the logs and the backend.
+	requestID := m.requestID(r)
+	repl.Set("ws.request_id", requestID)
+	// The real client IP, behind trusted proxies, keys the limits and is logged with
+	// every line of the connection.
+	clientIP := m.clientIP(r)
+	logger := m.logger.With(zap.String("request_id", requestID), zap.String("client_ip", clientIP))
+
+	// Reject upgrades with another method than GET before dialing the backend.
+	if r.Method != http.MethodGet {
+		m.denyUpgrade(logger, r, "method", zap.String("method", r.Method))
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_, err := io.WriteString(w, "Websocket upgrades must use GET.\n")
+		return err
+	}
+
+	// Keep credentials off plaintext connections, whatever the site serves.
+	if m.RequireTLS && !m.clientTLS(r) {
+		m.denyUpgrade(logger, r, "tls", zap.String("host", r.Host))
+		if m.RedirectToTLS {
+			// The plaintext port says nothing about the TLS one, so use the default.
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+				if strings.Contains(h, ":") {
+					host = "[" + h + "]"
+				}
+			}
+			target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+			http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+			return nil
+		}
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("websocket upgrades require TLS"))
+	}
+	// Keep clients outside of the allowed networks out.
+	if m.RemoteIP != nil && !m.RemoteIP.allowed(clientIP) {
+		m.denyUpgrade(logger, r, "remote_ip")
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("client IP not allowed: %s", clientIP))
+	}
+	// Keep clients that bypass the edge adding the required headers out. Only the name
+	// of the failing header is logged, as its value may be a secret.
+	if name := m.missingHeader(r.Header); name != "" {
+		m.denyUpgrade(logger, r, "required_header", zap.String("header", name))
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("missing or invalid required header: %s", name))
+	}
+	// Spare the backend the dials of clients reconnecting too often.
+	if m.RateLimit != nil {
+		if ok, wait := m.RateLimit.allow(clientIP, time.Now()); !ok {
+			m.denyUpgrade(logger, r, "rate_limit", zap.Duration("retry_after", wait))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return caddyhttp.Error(http.StatusTooManyRequests, fmt.Errorf("too many websocket upgrades from %s", clientIP))
+		}
+	}
+	// Keep sites other than the allowed ones from opening connections from browsers.
+	if !m.allowedOrigin(r) {
+		m.denyUpgrade(logger, r, "origin")
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("origin not allowed: %s", r.Header.Get("Origin")))
+	}
+	// Keep unauthenticated clients from reaching the backend.
+	if m.JWT != nil {
+		if err := m.JWT.verify(r, repl); err != nil {
+			m.denyUpgrade(logger, r, "jwt", zap.Error(err))
+			if m.JWT.TokenSource == "" || m.JWT.TokenSource == "header" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
 			}
+			return caddyhttp.Error(http.StatusUnauthorized, err)
+		}
+	}
+	if m.Ticket != nil {
+		if err := m.Ticket.verify(r, time.Now()); err != nil {
+			m.denyUpgrade(logger, r, "ticket", zap.Error(err))
+			return caddyhttp.Error(http.StatusForbidden, err)
+		}
+	}
+
+	// Keep a single client, or all of them, from opening too many connections. The
+	// count is released on every return path, once the connection is over.
+	if m.MaxConnections > 0 || m.MaxConnectionsPerIP > 0 {
+		ok, total, perIP := m.acquireConn(clientIP)
+		if !ok {
+			m.denyUpgrade(logger, r, "max_connections",
+				zap.Int("connections", total),
+				zap.Int("connections_from_ip", perIP),
+				zap.Int("max_connections", m.MaxConnections),
+				zap.Int("max_connections_per_ip", m.MaxConnectionsPerIP),
+			)
+			return caddyhttp.Error(http.StatusTooManyRequests, fmt.Errorf("too many websocket connections"))
 		}
+		defer m.releaseConn(clientIP)
+	}
+
+	if route.hostPattern != "" {
+		logger.Debug("selected backend by host",
+			zap.String("host", r.Host),
+			zap.String("pattern", route.hostPattern),
+			zap.Strings("backend_host", route.BackendHost),
+		)
+	}
+
+	// Get the subprotocols offered by the client.
+	offeredByClient := offeredProtocols(r.Header)
+	// Refuse clients offering a denied subprotocol, whatever else they offer.
+	if i := slices.IndexFunc(offeredByClient, func(p string) bool { return slices.Contains(m.DeniedSubprotocols, p) }); i >= 0 {
+		m.denyUpgrade(logger, r, "denied_subprotocol",
+			zap.String("subprotocol", offeredByClient[i]),
+			zap.Strings("offered", offeredByClient),
+		)
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("denied subprotocol offered: %s", offeredByClient[i]))
+	}
+	// Only offer the backend the allowed subprotocols, rejecting clients that have no
+	// acceptable offer.
+	if len(m.AllowedSubprotocols) > 0 {
+		offered := offeredByClient
+		offeredByClient = slices.DeleteFunc(slices.Clone(offered), func(p string) bool {
+			return !slices.Contains(m.AllowedSubprotocols, p)
+		})
+		if len(offeredByClient) == 0 && (len(offered) > 0 || m.RequireSubprotocol) {
+			m.denyUpgrade(logger, r, "subprotocol",
+				zap.Strings("offered", offered),
+				zap.Strings("allowed", m.AllowedSubprotocols),
+			)
+			return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("no allowed subprotocol offered: %q", offered))
+		}
+	}
+	if m.RequireSubprotocol && len(offeredByClient) == 0 {
+		m.denyUpgrade(logger, r, "subprotocol")
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("no subprotocol offered"))
+	}
+
+	// Offer the backend the default subprotocol when the client offered none.
+	offeredToBackend := offeredByClient
+	if len(offeredByClient) == 0 && m.DefaultSubprotocol != "" {
+		offeredToBackend = []string{m.DefaultSubprotocol}
+		logger.Debug("offering default subprotocol to backend",
+			zap.String("subprotocol", m.DefaultSubprotocol),
+		)
+	}
+
+	// Prefer the backend of an offered subprotocol, if any.
+	if pr := m.protocolRoute(offeredToBackend); pr != nil {
+		route = pr
+		logger.Debug("selected backend by subprotocol",
+			zap.String("subprotocol", pr.subprotocol),
+			zap.Strings("backend_host", pr.BackendHost),
+		)
 	}
 
-	// Construct the backend websocket URL.
-	backendURL := "ws://" + m.BackendHost + r.URL.String()
 	// Clone the client's headers and remove websocket-specific headers.
 	reqHeader := r.Header.Clone()
 	reqHeader.Del("Sec-WebSocket-Version")
@@ -125,112 +1274,400 @@ func (m *WSHeartbeat) ServeHTTP(w http.ResponseWriter, r *http.Request, next cad
 	reqHeader.Del("Sec-WebSocket-Protocol")
 	reqHeader.Del("Connection")
 	reqHeader.Del("Upgrade")
+	// Tell the backend who the client is.
+	m.setForwardedHeaders(r, reqHeader)
+	m.setClientCertHeaders(r, reqHeader)
+	reqHeader.Set(m.RequestIDHeader, requestID)
+	m.filterCookies(reqHeader)
+	if m.BackendAuth != nil {
+		m.BackendAuth.apply(reqHeader, repl)
+	}
+	// Rewrite the client's origin, already checked, for the backend.
+	switch m.OriginOverride {
+	case "":
+	case "none":
+		reqHeader.Del("Origin")
+	default:
+		reqHeader.Set("Origin", repl.ReplaceAll(m.OriginOverride, ""))
+	}
+	applyHeaderRules(m.HeaderUp, reqHeader, repl)
+
+	// Forward the normalized path when the match options loosened the comparison.
+	forwardURL := r.URL
+	if matchedPath != r.URL.Path {
+		normalized := *r.URL
+		normalized.Path, normalized.RawPath = matchedPath, ""
+		forwardURL = &normalized
+		logger.Debug("normalized request path",
+			zap.String("path", r.URL.Path),
+			zap.String("normalized_path", matchedPath),
+		)
+	}
 
-	// Use a websocket dialer to connect to the backend, passing the offered subprotocols.
-	dialer := websocket.Dialer{
-		Subprotocols: offeredByClient,
+	// Rewrite the path prefix before forwarding, preserving the query string.
+	if rest, ok := stripPathPrefix(forwardURL.Path, m.StripPrefix); ok {
+		rewritten := *forwardURL
+		rewritten.Path = repl.ReplaceAll(m.ReplacePrefix, "") + rest
+		rewritten.RawPath = ""
+		if !strings.HasPrefix(rewritten.Path, "/") {
+			rewritten.Path = "/" + rewritten.Path
+		}
+		logger.Debug("rewrote backend path",
+			zap.String("path", forwardURL.Path),
+			zap.String("rewritten_path", rewritten.Path),
+		)
+		forwardURL = &rewritten
 	}
-	backendConn, _, err := dialer.Dial(backendURL, reqHeader)
+
+	// Connect to the route's backend, passing the offered subprotocols.
+	// The client is never upgraded when no backend could be reached.
+	backendConn, backendResp, up, err := m.connectBackend(r, route, forwardURL, offeredToBackend, reqHeader)
 	if err != nil {
-		m.logger.Error("dial backend error", zap.Error(err))
+		// Let the backend's own answer reach the client.
+		var rejection *handshakeRejection
+		if errors.As(err, &rejection) {
+			return relayRejection(w, rejection)
+		}
+		var handlerErr caddyhttp.HandlerError
+		if m.retryAfter != "" && errors.As(err, &handlerErr) && handlerErr.StatusCode == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", m.retryAfter)
+		}
 		return err
 	}
+	// Release the upstream's connection count on every return path.
+	defer up.conns.Add(-1)
 
 	// Get the subprotocol chosen by the backend.
 	chosenByBackend := backendConn.Subprotocol()
+	// A client that offered no subprotocol must not receive one, even when the backend
+	// selected the default.
+	defaulted := len(offeredByClient) == 0 && m.DefaultSubprotocol != "" && chosenByBackend == m.DefaultSubprotocol
 
 	// Upgrade the client connection.
 	upgrader := websocket.Upgrader{
-		// Allow connections from any origin.
-		CheckOrigin: func(r *http.Request) bool { return true },
+		// The origin was checked before dialing the backend.
+		CheckOrigin:       func(r *http.Request) bool { return true },
+		EnableCompression: m.Compression == "terminate",
+	}
+	// Pass on the selected headers of the backend's handshake response, and the
+	// request ID if asked to.
+	respHeader := copyHeadersDown(m.HeaderDown, backendResp)
+	if respHeader == nil {
+		respHeader = make(http.Header)
 	}
-	// If the backend selected a subprotocol, include it in the upgrade.
-	if chosenByBackend != "" {
-		upgrader.Subprotocols = []string{chosenByBackend}
+	if m.RequestIDResponseHeader != "" {
+		respHeader.Set(m.RequestIDResponseHeader, requestID)
 	}
-	clientConn, err := upgrader.Upgrade(w, r, nil)
+	// If the backend selected one of the client's subprotocols, include it in the
+	// upgrade. The upgrader takes it from the response headers, as its own matching
+	// only sees the first Sec-WebSocket-Protocol line. A subprotocol the client didn't
+	// offer is only passed on with prefer_backend.
+	mismatch := chosenByBackend != "" && !defaulted && !slices.Contains(offeredByClient, chosenByBackend)
+	if chosenByBackend != "" && !defaulted && (!mismatch || m.SubprotocolMismatch == "prefer_backend") {
+		respHeader.Set("Sec-WebSocket-Protocol", chosenByBackend)
+	}
+	clientConn, err := upgrader.Upgrade(w, r, respHeader)
 	if err != nil {
 		_ = backendConn.Close()
 		return err
 	}
 
-	// Ensure the subprotocol selected by the client matches the backend's.
+	// Ensure the subprotocol selected by the client matches the backend's, before the
+	// connection is registered.
 	chosenByClient := clientConn.Subprotocol()
-	if chosenByBackend != chosenByClient {
-		_ = clientConn.Close()
-		_ = backendConn.Close()
-		return fmt.Errorf("subprotocol mismatch: backend=%q, client=%q", chosenByBackend, chosenByClient)
+	if chosenByBackend != chosenByClient && !defaulted {
+		if m.SubprotocolMismatch == "ignore" {
+			logger.Debug("ignoring subprotocol mismatch",
+				zap.String("backend", chosenByBackend),
+				zap.Strings("offered", offeredByClient),
+			)
+		} else {
+			logger.Warn("subprotocol mismatch, closing connection",
+				zap.String("backend", chosenByBackend),
+				zap.String("client", chosenByClient),
+				zap.Strings("offered", offeredByClient),
+			)
+			closeWith(websocket.CloseProtocolError, "subprotocol mismatch", m.pingWriteTimeoutDuration, clientConn, backendConn)
+			return nil
+		}
 	}
 
 	// Add the client connection to the active connections map.
+	sess := newSession(r.Context(), clientConn, backendConn, up, repl, m.pingWriteTimeoutDuration)
+	sess.logger = logger
+	sess.requestID, sess.clientIP = requestID, clientIP
 	m.mu.Lock()
-	m.connections[clientConn] = struct{}{}
+	m.connections[clientConn] = sess
 	m.mu.Unlock()
 
-	// Start a goroutine to send periodic pings to the client.
-	go m.handlePing(clientConn)
+	sess.client.readLimit = m.clientReadLimit
+	sess.backend.readLimit = m.backendReadLimit
+
+	// Resolve the client heartbeat of the request path once for the connection.
+	clientHeartbeat := m.clientHeartbeatFor(matchedPath, repl)
+
+	// A heartbeat protocol module sends its probes to the client instead of pings.
+	pingClient := clientHeartbeat.interval > 0 && m.heartbeatProtocol == nil
+
+	// Let pinged connections time out their reads unless pongs keep arriving. When
+	// pings may be skipped or suppressed, any message read keeps them open as well.
+	if m.readDeadlineGraceDuration > 0 && pingClient {
+		sess.client.readWindow = clientHeartbeat.readWindow(m.readDeadlineGraceDuration)
+	}
+	if m.readDeadlineGraceDuration > 0 && m.PingBackend && m.backendHeartbeat.interval > 0 {
+		sess.backend.readWindow = m.backendHeartbeat.readWindow(m.readDeadlineGraceDuration)
+	}
+	refreshOnRead := m.RefreshDeadlineOnRead || m.pingsMaySkip()
+	sess.client.refreshOnRead, sess.backend.refreshOnRead = refreshOnRead, refreshOnRead
+	// Relay the client's pings to the backend and its pongs back, if enabled.
+	if m.ForwardPings {
+		sess.client.pingsTo = &sess.backend
+		sess.backend.pongsTo = &sess.client
+	}
+	// Relay the backend's pings to the client, returning only timely pongs, if enabled.
+	if m.BackendPing == "relay" {
+		sess.backend.pingsTo = &sess.client
+		sess.client.pongsTo = &sess.backend
+		sess.client.relayTimeout = m.backendPingTimeoutDuration
+	}
+	// Pings read from either side prove it alive, and are answered or relayed.
+	m.handlePings(sess, &sess.client)
+	m.handlePings(sess, &sess.backend)
+	logger.Debug("proxying websocket connection",
+		zap.String("remote_addr", clientConn.RemoteAddr().String()),
+		zap.String("upstream", up.host),
+		zap.String("backend_ping", m.backendPingMode()),
+		zap.Duration("interval", clientHeartbeat.interval),
+	)
+	// Unsolicited pongs get no reply, so the peers' messages prove them alive instead.
+	sess.client.aliveOnRead = m.keepaliveFrameType == websocket.PongMessage && pingClient
+	sess.backend.aliveOnRead = m.keepaliveFrameType == websocket.PongMessage && m.PingBackend && m.backendHeartbeat.interval > 0
+	// Start a goroutine to send periodic pings to the client, and one for the backend
+	// if enabled. A zero interval turns the pings off. The pong handlers are set
+	// before the proxy starts reading.
+	if pingClient {
+		m.handlePongs(sess, &sess.client)
+		go m.handlePing(sess, &sess.client, clientHeartbeat)
+	} else if sess.client.pongsTo != nil {
+		m.handlePongs(sess, &sess.client)
+	}
+	if m.PingBackend && m.backendHeartbeat.interval > 0 {
+		m.handlePongs(sess, &sess.backend)
+		go m.handlePing(sess, &sess.backend, m.backendHeartbeat)
+	} else if sess.backend.pongsTo != nil {
+		m.handlePongs(sess, &sess.backend)
+	}
+	// Answer text pings locally on the configured sides.
+	if m.RespondToTextPing != nil {
+		sess.client.answerTextPings = m.RespondToTextPing.fromClient
+		sess.backend.answerTextPings = m.RespondToTextPing.fromBackend
+	}
+	// Start the text heartbeats, if enabled.
+	if m.TextHeartbeat != nil {
+		sess.client.textBeat = m.TextHeartbeat.beat
+		if m.TextHeartbeat.Backend {
+			sess.backend.textBeat = m.TextHeartbeat.beat
+		}
+	}
+	// The heartbeat protocol, if any, sends its own keep-alives to the client.
+	if beat := m.protocolBeat(chosenByClient, clientHeartbeat); beat != nil {
+		sess.client.textBeat = beat
+	}
+	if p := m.heartbeatProtocol; p != nil {
+		sess.client.textBeat = &textBeat{probe: p.MakeProbe, isReply: p.IsReply, timeout: clientHeartbeat.pongWait()}
+	}
+	if sess.client.textBeat != nil && clientHeartbeat.interval > 0 {
+		go m.handleTextHeartbeat(sess, &sess.client, clientHeartbeat.interval)
+	}
+	if sess.backend.textBeat != nil && m.backendHeartbeat.interval > 0 {
+		go m.handleTextHeartbeat(sess, &sess.backend, m.backendHeartbeat.interval)
+	}
 
 	// Set up error channels and proxy messages between client and backend.
 	errCh := make(chan error, 2)
-	go m.proxyWebSocket(clientConn, backendConn, errCh)
-	go m.proxyWebSocket(backendConn, clientConn, errCh)
+	go m.proxyWebSocket(sess, &sess.client, &sess.backend, errCh)
+	go m.proxyWebSocket(sess, &sess.backend, &sess.client, errCh)
 
 	// Wait for any error in the proxying.
 	err = <-errCh
-	// Close both connections on error.
+	// A read deadline that expired means a peer stopped answering the pings.
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		m.closeForHeartbeat(sess, "read deadline exceeded")
+	}
+	// Close both connections on error, then stop their writers.
 	_ = clientConn.Close()
 	_ = backendConn.Close()
+	sess.finish()
 
 	// Remove the client connection from the active connections map.
 	m.mu.Lock()
 	delete(m.connections, clientConn)
 	m.mu.Unlock()
 
-	return err
-}
-
-// proxyWebSocket copies messages between two websocket connections.
-func (m *WSHeartbeat) proxyWebSocket(src, dst *websocket.Conn, errCh chan error) {
-	for {
-		// Read message from the source connection.
-		msgType, msg, err := src.ReadMessage()
-		if err != nil {
-			errCh <- err
-			return
-		}
-		// Write the message to the destination connection.
-		err = dst.WriteMessage(msgType, msg)
-		if err != nil {
-			errCh <- err
-			return
-		}
+	// The response was hijacked by the upgrade, so the error that ended the
+	// connection is only logged: normal closes, and closes by the module, which logged
+	// their cause, at debug level, and others as warnings.
+	if normalClose(err) || sess.reason() != "" {
+		logger.Debug("websocket connection ended", zap.Error(err))
+	} else {
+		logger.Warn("websocket connection ended abnormally", zap.Error(err))
 	}
-}
-
-// handlePing sends periodic ping messages to a websocket connection to keep it alive.
-func (m *WSHeartbeat) handlePing(conn *websocket.Conn) {
-	// Create a ticker for the ping interval.
-	pingTicker := time.NewTicker(m.intervalDuration)
-	defer pingTicker.Stop()
 
-	// Set a pong handler to log when a pong is received.
-	conn.SetPongHandler(func(appData string) error {
-		m.logger.Debug("Received pong from client")
-		return nil
-	})
+	fields := []zap.Field{
+		zap.String("remote_addr", clientConn.RemoteAddr().String()),
+		zap.String("upstream", up.host),
+		zap.String("backend_ping", m.backendPingMode()),
+		zap.Duration("interval", clientHeartbeat.interval),
+	}
+	fields = append(fields, sess.fields()...)
+	fields = append(fields, sess.client.fields("")...)
+	if m.PingBackend {
+		fields = append(fields, sess.backend.fields("backend_")...)
+	}
+	if m.allowedMessageType != 0 {
+		fields = append(fields,
+			zap.Int64("violations_in", sess.client.violations.Load()),
+			zap.Int64("violations_out", sess.backend.violations.Load()),
+		)
+	}
+	if reason := sess.reason(); reason != "" {
+		fields = append(fields, zap.String("reason", reason))
+	}
+	logger.Info("websocket connection closed", fields...)
+
+	return nil
+}
+
+// stripPathPrefix returns path without prefix, if prefix is a whole leading segment
+// of it: "/api/v2" is stripped from "/api/v2" and "/api/v2/ws", but not "/api/v2ws".
+func stripPathPrefix(path, prefix string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok || prefix == "" {
+		return path, false
+	}
+	if rest != "" && !strings.HasPrefix(rest, "/") && !strings.HasSuffix(prefix, "/") {
+		return path, false
+	}
+	return rest, true
+}
+
+// matchQuery reports whether query has every parameter required by MatchQuery.
+func (m *WSHeartbeat) matchQuery(query url.Values) bool {
+	for key, want := range m.MatchQuery {
+		values, ok := query[key]
+		if !ok || (want != "*" && !slices.Contains(values, want)) {
+			return false
+		}
+	}
+	return true
+}
+
+// clientHeartbeatFor returns the client heartbeat of connections upgraded on path:
+// that of the first matching override, or else the handler's.
+func (m *WSHeartbeat) clientHeartbeatFor(path string, repl *caddy.Replacer) heartbeat {
+	for _, p := range m.Paths {
+		if repl.ReplaceAll(p.Path, "") == path {
+			return p.hb
+		}
+	}
+	return m.clientHeartbeat
+}
+
+// pingsMaySkip reports whether pings may be skipped or suppressed on a live
+// connection, leaving its read deadline to other traffic: in idle_only mode, with
+// suppressed pings, or with a heartbeat protocol.
+func (m *WSHeartbeat) pingsMaySkip() bool {
+	return m.IdleOnly || m.SuppressPings || m.Protocol != "" || m.heartbeatProtocol != nil
+}
 
-	// Send a ping on each tick.
+// backendPingMode returns how pings sent by the backend are handled, for logs.
+func (m *WSHeartbeat) backendPingMode() string {
+	if m.BackendPing == "" {
+		return "local"
+	}
+	return m.BackendPing
+}
+
+// proxyWebSocket copies messages between two legs of sess.
+func (m *WSHeartbeat) proxyWebSocket(sess *session, src, dst *leg, errCh chan error) {
 	for {
-		select {
-		case <-pingTicker.C:
-			// Write a ping message with a deadline.
-			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second))
-			if err != nil {
-				m.logger.Warn("Failed to send ping, closing connection", zap.Error(err))
+		// Read message from the source connection.
+		msgType, msg, err := src.readMessage()
+		if err != nil {
+			// Tell the side sending too large a message why it is closed.
+			var tooBig *messageTooBigError
+			if errors.As(err, &tooBig) {
+				sess.logger.Warn("closing websocket connection with a message over the size limit",
+					zap.String("side", src.name),
+					zap.Int64("size", tooBig.read),
+					zap.Int64("max_message_size", tooBig.limit),
+				)
+				sess.closeOffender(src, websocket.CloseMessageTooBig, "message too big",
+					fmt.Sprintf("message exceeds %d bytes", tooBig.limit))
+			}
+			errCh <- err
+			return
+		}
+		// Any message may count as proof of liveness for the read deadline, and for the
+		// pong timeouts of unsolicited pongs.
+		if src.refreshOnRead || src.aliveOnRead {
+			src.extendReadDeadline()
+		}
+		if src.aliveOnRead {
+			src.markAlive()
+		}
+		// Consume replies to our text heartbeats instead of forwarding them.
+		if src.textBeat != nil && src.textBeat.isReply != nil && src.textBeat.isReply(msgType, msg) &&
+			src.awaitingReply.CompareAndSwap(1, 0) {
+			select {
+			case src.textReplies <- struct{}{}:
+			default:
+			}
+			continue
+		}
+		// Let the heartbeat protocol learn from the message, which is still proxied.
+		m.observeProtocol(sess, src, msgType, msg)
+		// Answer text pings on the connection they came from.
+		if src.answerTextPings && m.RespondToTextPing.isPing(msgType, msg) {
+			if err := src.write(websocket.TextMessage, []byte(m.RespondToTextPing.Response)); err != nil {
+				errCh <- err
 				return
-			} else {
-				m.logger.Debug("Sent ping to client")
 			}
+			continue
+		}
+		// Keep the message types that aren't allowed from the other side.
+		if m.allowedMessageType != 0 && msgType != m.allowedMessageType {
+			src.violations.Add(1)
+			if m.OnViolation == "drop" {
+				sess.logger.Debug("dropped websocket message of a type not allowed",
+					zap.String("side", src.name),
+					zap.String("message_type", messageTypeName(msgType)),
+				)
+				continue
+			}
+			sess.logger.Info("closing websocket connection with a message of a type not allowed",
+				zap.String("side", src.name),
+				zap.String("message_type", messageTypeName(msgType)),
+			)
+			sess.closeOffender(src, websocket.CloseUnsupportedData, "message type not allowed",
+				messageTypeName(msgType)+" messages not allowed")
+			errCh <- fmt.Errorf("%s message from %s not allowed", messageTypeName(msgType), src.name)
+			return
+		}
+		// Write the message to the destination connection.
+		err = dst.write(msgType, msg)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		// Count the message and record the activity for idle_only pings. As it postpones
+		// the pings of both legs, it pushes the read deadline of the receiver out too.
+		src.messages.Add(1)
+		src.bytes.Add(int64(len(msg)))
+		sess.touch()
+		if m.IdleOnly {
+			dst.extendReadDeadline()
 		}
 	}
 }
@@ -247,15 +1684,864 @@ func (m *WSHeartbeat) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					return d.ArgErr()
 				}
 				m.Interval = d.Val()
+			case "max_missed_pongs":
+				// Parse the missed pong threshold.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				missed, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_missed_pongs: %v", err)
+				}
+				m.MaxMissedPongs = missed
+			case "client":
+				// Parse the client heartbeat section.
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.Client == nil {
+					m.Client = &HeartbeatConfig{}
+				}
+				if err := m.Client.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "path":
+				// Parse a per-path override of the client heartbeat.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				p := &PathHeartbeat{Path: d.Val()}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if err := p.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+				m.Paths = append(m.Paths, p)
+			case "allowed_message_types", "on_violation":
+				// Parse the message types proxied, or what happens to the others.
+				option := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if option == "allowed_message_types" {
+					m.AllowedMessageTypes = d.Val()
+				} else {
+					m.OnViolation = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "max_message_size":
+				// Parse the message size limit, of both sides or of the given one.
+				args := d.RemainingArgs()
+				switch {
+				case len(args) == 1:
+					m.MaxMessageSize = args[0]
+				case len(args) == 2 && args[0] == "client":
+					m.MaxClientMessageSize = args[1]
+				case len(args) == 2 && args[0] == "backend":
+					m.MaxBackendMessageSize = args[1]
+				default:
+					return d.ArgErr()
+				}
+			case "ping_backend":
+				// Parse the backend ping toggle, on when given without a value.
+				m.PingBackend = true
+				if d.NextArg() {
+					switch d.Val() {
+					case "on":
+					case "off":
+						m.PingBackend = false
+					default:
+						return d.Errf("ping_backend must be on or off, got %s", d.Val())
+					}
+				}
+			case "backend_interval":
+				// Parse the backend ping interval.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.BackendInterval = d.Val()
+			case "text_heartbeat":
+				// Parse the text heartbeat message and options.
+				m.TextHeartbeat = &TextHeartbeat{}
+				if err := m.TextHeartbeat.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "protocol":
+				// Parse the heartbeat protocol.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Protocol = d.Val()
+				if d.NextArg() {
+					if d.Val() != "suppress_pings" {
+						return d.Errf("unknown protocol option: %s", d.Val())
+					}
+					m.SuppressPings = true
+				}
+			case "heartbeat_protocol":
+				// Parse the heartbeat protocol module and its options.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.HeartbeatProtocolRaw != nil {
+					return d.Err("heartbeat protocol already specified")
+				}
+				name := d.Val()
+				modID := "http.handlers.ws_heartbeat.protocols." + name
+				unm, err := caddyfile.UnmarshalModule(d, modID)
+				if err != nil {
+					return err
+				}
+				protocol, ok := unm.(HeartbeatProtocol)
+				if !ok {
+					return d.Errf("module %s (%T) is not a HeartbeatProtocol", modID, unm)
+				}
+				m.HeartbeatProtocolRaw = caddyconfig.JSONModuleObject(protocol, "name", name, nil)
+			case "respond_to_text_ping":
+				// Parse the text ping request, response and directions.
+				m.RespondToTextPing = &TextPingResponder{}
+				if err := m.RespondToTextPing.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "jitter":
+				// Parse the jitter and whether it applies to every interval.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Jitter = d.Val()
+				if d.NextArg() {
+					if d.Val() != "per_interval" {
+						return d.Errf("unknown jitter option: %s", d.Val())
+					}
+					m.JitterPerInterval = true
+				}
+			case "keepalive_frame":
+				// Parse the type of the periodic control frame.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.KeepaliveFrame = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "heartbeat_close_code":
+				// Parse the close code sent for failed heartbeats.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				code, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid heartbeat_close_code: %v", err)
+				}
+				m.HeartbeatCloseCode = code
+			case "heartbeat_close_reason":
+				// Parse the close reason sent for failed heartbeats.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.HeartbeatCloseReason = d.Val()
+			case "forward_pings":
+				// Enable relaying client pings to the backend.
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ForwardPings = true
+			case "backend_ping":
+				// Parse the handling of backend pings and the optional relay timeout.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.BackendPing = d.Val()
+				if d.NextArg() {
+					m.BackendPingTimeout = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "adaptive":
+				// Parse the adaptive interval bounds.
+				if m.Adaptive == nil {
+					m.Adaptive = &AdaptiveConfig{}
+				}
+				if err := m.Adaptive.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "idle_only":
+				// Enable pinging only idle connections.
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.IdleOnly = true
+			case "initial_delay":
+				// Parse the delay before the first ping.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.InitialDelay = d.Val()
+			case "ping_write_timeout":
+				// Parse the control frame write timeout.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.PingWriteTimeout = d.Val()
+			case "read_deadline_grace":
+				// Parse the read deadline grace and whether any read refreshes it.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ReadDeadlineGrace = d.Val()
+				if d.NextArg() {
+					if d.Val() != "refresh_on_read" {
+						return d.Errf("unknown read_deadline_grace option: %s", d.Val())
+					}
+					m.RefreshDeadlineOnRead = true
+				}
+			case "ping_payload":
+				// Parse the ping application data.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.PingPayload = d.Val()
+			case "pong_timeout":
+				// Parse the pong timeout value.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.PongTimeout = d.Val()
+			case "lb_policy":
+				// Parse the load balancing policy.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.LBPolicy = d.Val()
+			case "health_interval":
+				// Parse the active health check interval.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.HealthInterval = d.Val()
+			case "health_path":
+				// Parse the active health check path.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.HealthPath = d.Val()
+			case "fail_duration":
+				// Parse the circuit breaker open duration.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.FailDuration = d.Val()
+			case "close_on_unhealthy":
+				// Parse the optional grace period and close code.
+				m.CloseOnUnhealthy = true
+				if d.NextArg() {
+					m.UnhealthyGrace = d.Val()
+				}
+				if d.NextArg() {
+					code, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("invalid close_on_unhealthy close code: %v", err)
+					}
+					m.UnhealthyCloseCode = code
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "max_fails":
+				// Parse the circuit breaker failure threshold.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				fails, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_fails: %v", err)
+				}
+				m.MaxFails = fails
+			case "max_conns_per_upstream":
+				// Parse the per-host connection cap.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				conns, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_conns_per_upstream: %v", err)
+				}
+				m.MaxConnsPerUpstream = conns
+			case "max_connections", "max_connections_per_ip":
+				// Parse the handler's total or per-IP connection cap.
+				option := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				conns, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid %s: %v", option, err)
+				}
+				if option == "max_connections" {
+					m.MaxConnections = conns
+				} else {
+					m.MaxConnectionsPerIP = conns
+				}
+			case "retry_after":
+				// Parse the Retry-After value sent with 503 responses.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.RetryAfter = d.Val()
+			case "upstreams":
+				// Parse the dynamic upstream source module and its options.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.UpstreamsRaw != nil {
+					return d.Err("dynamic upstreams already specified")
+				}
+				dynModule := d.Val()
+				modID := "http.reverse_proxy.upstreams." + dynModule
+				unm, err := caddyfile.UnmarshalModule(d, modID)
+				if err != nil {
+					return err
+				}
+				source, ok := unm.(reverseproxy.UpstreamSource)
+				if !ok {
+					return d.Errf("module %s (%T) is not an UpstreamSource", modID, unm)
+				}
+				m.UpstreamsRaw = caddyconfig.JSONModuleObject(source, "source", dynModule, nil)
+			case "upstreams_scheme":
+				// Parse the scheme used to dial dynamic upstreams.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.UpstreamsScheme = d.Val()
+			case "dial_timeout":
+				// Parse the backend dial timeout.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.DialTimeout = d.Val()
+			case "dial_retries":
+				// Parse the number of backend dial retries.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				retries, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid dial_retries: %v", err)
+				}
+				m.DialRetries = retries
+			case "dial_retry_interval":
+				// Parse the initial wait between dial retries.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.DialRetryInterval = d.Val()
 			case "backend":
-				// Parse the backend host and paths.
+				// Parse the backend hosts and paths; paths are the arguments starting
+				// with "/". The first backend line configures BackendHost and
+				// BackendPaths; further lines add routes.
+				// The hosts may be omitted when dynamic upstreams are used.
+				// Without arguments, a block configures the backend heartbeat; NextArg
+				// stops at its opening brace.
+				if !d.NextArg() {
+					line := d.Line()
+					if d.Next() {
+						block := d.Val() == "{" && d.Line() == line
+						d.Prev()
+						if !block {
+							return d.ArgErr()
+						}
+						if m.Backend == nil {
+							m.Backend = &HeartbeatConfig{}
+						}
+						if err := m.Backend.unmarshalCaddyfile(d); err != nil {
+							return err
+						}
+						continue
+					}
+					return d.ArgErr()
+				}
+				// A host may be followed by "weight <n>".
+				route := &BackendRoute{}
+				weights := map[int]int{}
+				for ok := true; ok; ok = d.NextArg() {
+					switch {
+					case strings.HasPrefix(d.Val(), "/"), strings.HasPrefix(d.Val(), "~"):
+						route.BackendPaths = append(route.BackendPaths, d.Val())
+					case len(route.BackendPaths) > 0:
+						return d.Errf("backend host %s must come before the paths", d.Val())
+					case d.Val() == "weight" && len(route.BackendHost) > 0:
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						weight, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("invalid weight: %v", err)
+						}
+						weights[len(route.BackendHost)-1] = weight
+					default:
+						route.BackendHost = append(route.BackendHost, d.Val())
+					}
+				}
+				// Hosts without an explicit weight default to 1.
+				if len(weights) > 0 {
+					for i := range route.BackendHost {
+						weight, ok := weights[i]
+						if !ok {
+							weight = 1
+						}
+						route.BackendWeights = append(route.BackendWeights, weight)
+					}
+				}
+				if len(m.BackendHost) == 0 && len(m.BackendPaths) == 0 {
+					m.BackendHost, m.BackendPaths, m.BackendWeights = route.BackendHost, route.BackendPaths, route.BackendWeights
+				} else {
+					m.Routes = append(m.Routes, route)
+				}
+			case "insecure_skip_verify":
+				// Disable backend TLS verification; takes no arguments.
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.InsecureSkipVerify = true
+			case "trusted_ca":
+				// Parse one or more CA certificate files.
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
-				m.BackendHost = d.Val()
+				m.TrustedCACerts = append(m.TrustedCACerts, d.Val())
 				for d.NextArg() {
-					m.BackendPaths = append(m.BackendPaths, d.Val())
+					m.TrustedCACerts = append(m.TrustedCACerts, d.Val())
+				}
+			case "client_certificate_file":
+				// Parse the client certificate file.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ClientCertificateFile = d.Val()
+			case "client_certificate_key_file":
+				// Parse the client certificate key file.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ClientCertificateKeyFile = d.Val()
+			case "tls_server_name":
+				// Parse the TLS server name override.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.TLSServerName = d.Val()
+			case "srv_cache_ttl":
+				// Parse the SRV cache TTL.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.SRVCacheTTL = d.Val()
+			case "exclude_paths":
+				// Parse the paths never proxied.
+				paths := d.RemainingArgs()
+				if len(paths) == 0 {
+					return d.ArgErr()
+				}
+				m.ExcludePaths = append(m.ExcludePaths, paths...)
+			case "request_id_header":
+				// Parse the request ID header.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.RequestIDHeader = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "request_id_response_header":
+				// Parse the header returning the request ID to the client.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.RequestIDResponseHeader = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "client_cert_fields":
+				// Parse the client certificate fields forwarded to the backend.
+				fields := d.RemainingArgs()
+				if len(fields) == 0 {
+					return d.ArgErr()
+				}
+				m.ClientCertFields = fields
+			case "trusted_proxies":
+				// Parse the networks of the proxies in front of Caddy.
+				networks := d.RemainingArgs()
+				if len(networks) == 0 {
+					return d.ArgErr()
+				}
+				m.TrustedProxies = append(m.TrustedProxies, networks...)
+			case "rate_limit":
+				// Parse "<events> per <window>", the window being a duration or a unit.
+				args := d.RemainingArgs()
+				if len(args) != 3 || args[1] != "per" {
+					return d.ArgErr()
+				}
+				events, err := strconv.Atoi(args[0])
+				if err != nil {
+					return d.Errf("invalid rate_limit events: %v", err)
+				}
+				window := args[2]
+				switch window {
+				case "second":
+					window = "1s"
+				case "minute":
+					window = "1m"
+				case "hour":
+					window = "1h"
+				}
+				m.RateLimit = &RateLimit{Events: events, Window: window}
+			case "remote_ip":
+				// Parse the allowed or denied client networks.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				list := d.Val()
+				networks := d.RemainingArgs()
+				if len(networks) == 0 {
+					return d.ArgErr()
+				}
+				if m.RemoteIP == nil {
+					m.RemoteIP = &RemoteIPRules{}
+				}
+				switch list {
+				case "allow":
+					m.RemoteIP.Allow = append(m.RemoteIP.Allow, networks...)
+				case "deny":
+					m.RemoteIP.Deny = append(m.RemoteIP.Deny, networks...)
+				default:
+					return d.Errf("remote_ip must be allow or deny, got %s", list)
+				}
+			case "jwt":
+				// Parse the validation of the clients' tokens.
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.JWT == nil {
+					m.JWT = &JWTAuth{}
+				}
+				if err := m.JWT.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "ticket":
+				// Parse the validation of the application's tickets.
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.Ticket == nil {
+					m.Ticket = &Ticket{}
+				}
+				if err := m.Ticket.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "backend_auth":
+				// Parse the credentials of the backend handshake.
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.BackendAuth == nil {
+					m.BackendAuth = &BackendAuth{}
+				}
+				if err := m.BackendAuth.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "cookies":
+				// Parse the policy for the client's cookies, with the names it allows.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Cookies = d.Val()
+				names := d.RemainingArgs()
+				if (m.Cookies == "allow") != (len(names) > 0) {
+					return d.ArgErr()
+				}
+				m.AllowedCookies = append(m.AllowedCookies, names...)
+			case "header_up":
+				// Parse a change to the backend handshake headers.
+				rule, err := parseHeaderRule(d)
+				if err != nil {
+					return err
+				}
+				m.HeaderUp = append(m.HeaderUp, rule)
+			case "header_down":
+				// Parse the backend handshake response headers copied to the client.
+				names := d.RemainingArgs()
+				if len(names) == 0 {
+					return d.ArgErr()
+				}
+				m.HeaderDown = append(m.HeaderDown, names...)
+			case "backend_paths_file":
+				// Parse the file of further backend paths.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.BackendPathsFile = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "reload_interval":
+				// Parse how often the backend paths file is re-read.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ReloadInterval = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "non_websocket":
+				// Parse the handling of requests that aren't upgrades.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.NonWebSocket = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "preflight":
+				// Parse the answer to OPTIONS requests, with its optional block.
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.Preflight == nil {
+					m.Preflight = &Preflight{}
+				}
+				if err := m.Preflight.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+			case "host_routes":
+				// Parse the host pattern to backend host mapping.
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.HostRoutes == nil {
+					m.HostRoutes = make(map[string]HostList)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					pattern := d.Val()
+					hosts := d.RemainingArgs()
+					if len(hosts) == 0 {
+						return d.ArgErr()
+					}
+					m.HostRoutes[pattern] = append(m.HostRoutes[pattern], hosts...)
+				}
+			case "unmatched_host":
+				// Parse the handling of hosts matching no host route.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.UnmatchedHost = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "origins":
+				// Parse the allowed origins.
+				origins := d.RemainingArgs()
+				if len(origins) == 0 {
+					return d.ArgErr()
+				}
+				m.Origins = append(m.Origins, origins...)
+			case "origin_override":
+				// Parse the Origin header sent to the backend.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.OriginOverride = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "require_origin":
+				// Parse the optional on/off flag; no argument means on.
+				m.RequireOrigin = true
+				if d.NextArg() {
+					switch d.Val() {
+					case "on":
+					case "off":
+						m.RequireOrigin = false
+					default:
+						return d.Errf("require_origin must be on or off, got %s", d.Val())
+					}
+				}
+			case "metrics":
+				// Parse the optional on/off flag; no argument means on.
+				m.Metrics = true
+				if d.NextArg() {
+					switch d.Val() {
+					case "on":
+					case "off":
+						m.Metrics = false
+					default:
+						return d.Errf("metrics must be on or off, got %s", d.Val())
+					}
+				}
+			case "require_header":
+				// Parse a required header, with the optional pattern of its value.
+				args := d.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				required := RequiredHeader{Name: args[0]}
+				if len(args) == 2 {
+					required.Value = args[1]
+				}
+				m.RequireHeaders = append(m.RequireHeaders, required)
+			case "require_tls":
+				// Parse the optional on/off flag, or redirect; no argument means on.
+				m.RequireTLS, m.RedirectToTLS = true, false
+				if d.NextArg() {
+					switch d.Val() {
+					case "on":
+					case "redirect":
+						m.RedirectToTLS = true
+					case "off":
+						m.RequireTLS = false
+					default:
+						return d.Errf("require_tls must be on, off or redirect, got %s", d.Val())
+					}
+				}
+			case "compression":
+				// Parse the compression mode.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Compression = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "default_subprotocol":
+				// Parse the subprotocol offered for clients offering none.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.DefaultSubprotocol = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "subprotocol_mismatch":
+				// Parse the handling of subprotocol selections the client didn't offer.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.SubprotocolMismatch = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "allowed_subprotocols":
+				// Parse the subprotocols allowed from clients.
+				protocols := d.RemainingArgs()
+				if len(protocols) == 0 {
+					return d.ArgErr()
+				}
+				m.AllowedSubprotocols = append(m.AllowedSubprotocols, protocols...)
+			case "denied_subprotocols":
+				// Parse the subprotocols refused from clients.
+				protocols := d.RemainingArgs()
+				if len(protocols) == 0 {
+					return d.ArgErr()
+				}
+				m.DeniedSubprotocols = append(m.DeniedSubprotocols, protocols...)
+			case "require_subprotocol":
+				// Parse the optional on/off flag; no argument means on.
+				m.RequireSubprotocol = true
+				if d.NextArg() {
+					switch d.Val() {
+					case "on":
+					case "off":
+						m.RequireSubprotocol = false
+					default:
+						return d.Errf("require_subprotocol must be on or off, got %s", d.Val())
+					}
+				}
+			case "protocol_routes":
+				// Parse the subprotocol to backend host mapping.
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.ProtocolRoutes == nil {
+					m.ProtocolRoutes = make(map[string]HostList)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					subprotocol := d.Val()
+					hosts := d.RemainingArgs()
+					if len(hosts) == 0 {
+						return d.ArgErr()
+					}
+					m.ProtocolRoutes[subprotocol] = append(m.ProtocolRoutes[subprotocol], hosts...)
+				}
+			case "match_query":
+				// Parse a required query parameter and its value.
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if m.MatchQuery == nil {
+					m.MatchQuery = make(map[string]string)
+				}
+				m.MatchQuery[args[0]] = args[1]
+			case "match_options":
+				// Parse the path comparison options.
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.MatchOptions == nil {
+					m.MatchOptions = &MatchOptions{}
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "case_insensitive":
+						m.MatchOptions.CaseInsensitive = true
+					case "ignore_trailing_slash":
+						m.MatchOptions.IgnoreTrailingSlash = true
+					default:
+						return d.Errf("unknown match_options option: %s", d.Val())
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+			case "strip_prefix":
+				// Parse the prefix and its optional replacement.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.StripPrefix = d.Val()
+				if d.NextArg() {
+					m.ReplacePrefix = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "host_header":
+				// Parse the Host header override.
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.HostHeader = d.Val()
+			case "preserve_host":
+				// Parse the optional on/off flag; no argument means on.
+				m.PreserveHost = true
+				if d.NextArg() {
+					switch d.Val() {
+					case "on":
+					case "off":
+						m.PreserveHost = false
+					default:
+						return d.Errf("preserve_host must be on or off, got %s", d.Val())
+					}
+				}
+			case "forward_proxy":
+				// Parse the forward proxy URL.
+				if !d.NextArg() {
+					return d.ArgErr()
 				}
+				m.ForwardProxy = d.Val()
 			default:
 				return d.ArgErr()
 			}
@@ -278,5 +2564,6 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 var (
 	_ caddyfile.Unmarshaler       = (*WSHeartbeat)(nil)
 	_ caddy.Provisioner           = (*WSHeartbeat)(nil)
+	_ caddy.CleanerUpper          = (*WSHeartbeat)(nil)
 	_ caddyhttp.MiddlewareHandler = (*WSHeartbeat)(nil)
 )
@@ -0,0 +1,250 @@
+package wsheartbeat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// provisionTest provisions m, failing t on error, and cleans it up after the test.
+func provisionTest(t *testing.T, m *WSHeartbeat) {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := m.Provision(ctx); err != nil {
+		t.Fatalf("provisioning: %v", err)
+	}
+	t.Cleanup(func() { _ = m.Cleanup() })
+}
+
+// echoBackend starts a websocket backend echoing every message, after calling
+// onUpgrade with the handshake request if set.
+func echoBackend(t *testing.T, onUpgrade func(r *http.Request)) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if onUpgrade != nil {
+			onUpgrade(r)
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(msgType, msg); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// serveProxy provisions m in front of backend, on the path /ws unless m has backend
+// paths, and returns a server running it as Caddy would.
+func serveProxy(t *testing.T, m *WSHeartbeat, backend *httptest.Server) *httptest.Server {
+	t.Helper()
+	if backend != nil {
+		m.BackendHost = HostList{strings.TrimPrefix(backend.URL, "http://")}
+	}
+	if len(m.BackendPaths) == 0 {
+		m.BackendPaths = []string{"/ws"}
+	}
+	provisionTest(t, m)
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	})
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repl := caddy.NewReplacer()
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+		var handlerErr caddyhttp.HandlerError
+		if err := m.ServeHTTP(w, r, next); errors.As(err, &handlerErr) {
+			w.WriteHeader(handlerErr.StatusCode)
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+// dialProxy opens a websocket connection to path on proxy.
+func dialProxy(t *testing.T, proxy *httptest.Server, path string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	dialer := websocket.Dialer{HandshakeTimeout: 5 * time.Second}
+	return dialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http")+path, header)
+}
+
+// waitFor polls cond until it holds, failing t after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProxyEcho(t *testing.T) {
+	proxy := serveProxy(t, &WSHeartbeat{}, echoBackend(t, nil))
+	conn, _, err := dialProxy(t, proxy, "/ws", nil)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := conn.ReadMessage()
+	if err != nil || string(msg) != "hello" {
+		t.Fatalf("got %q, %v; want hello", msg, err)
+	}
+}
+
+// compressingBackend starts a websocket backend echoing every message, with
+// permessage-deflate enabled, which sends the extensions the proxy offered on offers.
+func compressingBackend(t *testing.T, offers chan<- string) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offers <- r.Header.Get("Sec-WebSocket-Extensions")
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(msgType, msg); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestCompressionTerminate(t *testing.T) {
+	tests := []struct {
+		compression string
+		// compressed reports whether both legs are expected to negotiate permessage-deflate.
+		compressed bool
+	}{
+		{"terminate", true},
+		{"off", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.compression, func(t *testing.T) {
+			offers := make(chan string, 1)
+			proxy := serveProxy(t, &WSHeartbeat{Compression: tt.compression}, compressingBackend(t, offers))
+			dialer := websocket.Dialer{EnableCompression: true, HandshakeTimeout: 5 * time.Second}
+			conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http")+"/ws", nil)
+			if err != nil {
+				t.Fatalf("dialing: %v", err)
+			}
+			defer conn.Close()
+
+			clientLeg := strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+			backendLeg := strings.Contains(<-offers, "permessage-deflate")
+			if clientLeg != tt.compressed || backendLeg != tt.compressed {
+				t.Fatalf("permessage-deflate negotiated with the client: %v, offered to the backend: %v; want %v",
+					clientLeg, backendLeg, tt.compressed)
+			}
+
+			// Compressed payloads must come back intact, through decompression and
+			// recompression on each leg.
+			conn.EnableWriteCompression(true)
+			for _, payload := range [][]byte{
+				bytes.Repeat([]byte("compress me "), 10000),
+				[]byte("short"),
+				{},
+			} {
+				if err := conn.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+					t.Fatal(err)
+				}
+				msgType, msg, err := conn.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if msgType != websocket.BinaryMessage || !bytes.Equal(msg, payload) {
+					t.Fatalf("echoed %d bytes of type %d, want the %d bytes sent", len(msg), msgType, len(payload))
+				}
+			}
+		})
+	}
+}
+
+func TestStripPathPrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix, want string
+		ok                 bool
+	}{
+		{"/api/v2/ws", "/api/v2", "/ws", true},
+		{"/api/v2", "/api/v2", "", true},
+		{"/api/v2/", "/api/v2", "/", true},
+		{"/api/v2ws", "/api/v2", "/api/v2ws", false},
+		{"/api/v2/ws", "/api/v2/", "ws", true},
+		{"/other/ws", "/api/v2", "/other/ws", false},
+		{"/ws", "", "/ws", false},
+	}
+	for _, tt := range tests {
+		got, ok := stripPathPrefix(tt.path, tt.prefix)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("stripPathPrefix(%q, %q) = %q, %v; want %q, %v", tt.path, tt.prefix, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestStripPrefixForwardsRewrittenPath(t *testing.T) {
+	paths := make(chan string, 1)
+	backend := echoBackend(t, func(r *http.Request) { paths <- r.URL.RequestURI() })
+	m := &WSHeartbeat{BackendPaths: []string{"/api/v2/ws", "/api/v2ws"}, StripPrefix: "/api/v2"}
+	proxy := serveProxy(t, m, backend)
+	core, logs := observer.New(zap.DebugLevel)
+	m.logger = zap.New(core)
+
+	for path, want := range map[string]string{
+		"/api/v2/ws?x=1": "/ws?x=1",
+		"/api/v2ws?x=1":  "/api/v2ws?x=1",
+	} {
+		conn, _, err := dialProxy(t, proxy, path, nil)
+		if err != nil {
+			t.Fatalf("dialing %s: %v", path, err)
+		}
+		conn.Close()
+		if got := <-paths; got != want {
+			t.Errorf("%s forwarded as %s, want %s", path, got, want)
+		}
+	}
+
+	// The debug log has the path before and after the rewrite.
+	rewrites := logs.FilterMessage("rewrote backend path").All()
+	if len(rewrites) != 1 {
+		t.Fatalf("logged %d rewrites, want 1", len(rewrites))
+	}
+	fields := rewrites[0].ContextMap()
+	if fields["path"] != "/api/v2/ws" || fields["rewritten_path"] != "/ws" {
+		t.Fatalf("rewrite logged as %v, want path /api/v2/ws rewritten to /ws", fields)
+	}
+}